@@ -1,207 +1,701 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Brodyzera/chgentree/tree"
+	"gopkg.in/yaml.v3"
 )
 
-// Node is a type that contains Organization data as well as a list of references to children Nodes.
-type Node struct {
-	mux                  sync.Mutex // For locking Children Node array
-	BusinessOrganization Organization
-	Children             []*Node
+// allowedWrite describes a non-GET request the client is permitted to make.
+type allowedWrite struct {
+	Method string
+	Path   *regexp.Regexp
+	Reason string
 }
 
-// Organization is a type that contains an Organizations Name and ID, as well as a list of sub-Organizations.
-type Organization struct {
-	Name               string
-	ID                 string
-	SubOrganizationIds []string
-	Environments       []*Environment
+// allowedWrites is the complete list of non-GET requests chgentree may issue.  Anything else is
+// rejected by readOnlyTransport before it leaves the process.
+var allowedWrites = []allowedWrite{
+	{http.MethodPost, regexp.MustCompile(`^/accounts/api/v2/oauth2/token$`), "token exchange"},
 }
 
-// Environment is a type that contains an Environemnt Name and ID.
-type Environment struct {
-	ID           string
-	Name         string
-	Applications []*Application
+// readOnlyTransport rejects any request that is not a GET or an allow-listed write.
+type readOnlyTransport struct {
+	next http.RoundTripper
 }
 
-// Application is a type that contains an Application Domain, Full Domain, Status, and File Name.
-type Application struct {
-	Domain     string
-	FullDomain string
-	Status     string
-	FileName   string
-	Workers    struct {
-		Type struct {
-			CPU string
-		} `json:"type"`
-		Amount              int
-		RemainingOrgWorkers float32
-		TotalOrgWorkers     float32
-	} `json:"workers"`
-	LastUpdateTime int
-	MuleVersion    struct {
-		Version string
-	} `json:"muleVersion"`
+// rejectedRequests counts requests blocked by readOnlyTransport.  Any non-zero value is a bug.
+var rejectedRequests uint64
+
+// RoundTrip implements http.RoundTripper.
+func (t *readOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && !isAllowedWrite(req) {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		atomic.AddUint64(&rejectedRequests, 1)
+		slog.Error("BUG: rejected request, chgentree is read-only", "method", req.Method, "path", req.URL.Path)
+		return nil, fmt.Errorf("read-only client: %s %s is not allow-listed", req.Method, req.URL.Path)
+	}
+
+	return t.next.RoundTrip(req)
 }
 
-// To be set my the command line.
-var rootID, username, password *string
+func isAllowedWrite(req *http.Request) bool {
+	for _, w := range allowedWrites {
+		if req.Method == w.Method && w.Path.MatchString(req.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
 
-func errorCheck(err error) {
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s", err)
-		os.Exit(1)
+// verifyPins returns a tls.Config.VerifyConnection callback that requires the SPKI SHA-256 hash of
+// the leaf or a chain certificate to match one of pins.
+func verifyPins(pins []string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		var presented []string
+		for _, cert := range cs.PeerCertificates {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			hash := base64.StdEncoding.EncodeToString(sum[:])
+			for _, pin := range pins {
+				if hash == pin {
+					return nil
+				}
+			}
+			presented = append(presented, hash)
+		}
+		return fmt.Errorf("pin mismatch: presented SPKI hashes %s", strings.Join(presented, ", "))
 	}
 }
 
-// InitTree initializes a new organization heirarchy tree.
-func InitTree() *Node {
-	g := &sync.WaitGroup{}
+// hedgedTransport sends a duplicate of any GET that hasn't completed within after, returning whichever
+// attempt finishes first and cancelling the other.  budget is the number of hedges left for the run.
+// A hedge is only sent when slots has one free, so duplicates count against -max-concurrent too.
+type hedgedTransport struct {
+	next   http.RoundTripper
+	after  time.Duration
+	budget int64
+	slots  slotPool
+}
 
-	// Construct root Node
-	byteArray := getOrganizationMetrics(*rootID)
-	var organization Organization
-	json.Unmarshal(byteArray, &organization)
-	node := &Node{BusinessOrganization: organization, Children: nil}
+// slotPool hands out the concurrency slots shared by every request.  *tree.Client implements it.
+type slotPool interface {
+	TryAcquireSlot() bool
+	ReleaseSlot()
+}
 
-	// Build remaining Nodes
-	g.Add(1)
-	node.buildOrgTree(g)
-	g.Wait()
+// hedgedRequests counts the duplicate requests sent by hedgedTransport.
+var hedgedRequests uint64
 
-	return node
+type hedgeResult struct {
+	attempt int
+	resp    *http.Response
+	err     error
 }
 
-func (p *Node) buildOrgTree(g *sync.WaitGroup) {
-	defer g.Done()
-	for _, v := range p.BusinessOrganization.SubOrganizationIds {
-		byteArray := getOrganizationMetrics(v)
-		var organization Organization
-		json.Unmarshal(byteArray, &organization)
+// cancelOnClose releases a winning attempt's context once its body has been consumed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
 
-		node := &Node{BusinessOrganization: organization, Children: nil}
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
 
-		p.mux.Lock()
-		p.Children = append(p.Children, node)
-		p.mux.Unlock()
+// RoundTrip implements http.RoundTripper.
+func (t *hedgedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.next.RoundTrip(req)
+	}
 
-		g.Add(1)
-		go node.buildOrgTree(g)
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	// send starts an attempt.  release, if set, frees the attempt's slot once it fails or its body
+	// is closed.
+	send := func(release func()) {
+		ctx, cancel := context.WithCancel(req.Context())
+		attempt := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := t.next.RoundTrip(req.Clone(ctx))
+			if release != nil {
+				if err != nil {
+					release()
+				} else {
+					resp.Body = cancelOnClose{resp.Body, release}
+				}
+			}
+			results <- hedgeResult{attempt, resp, err}
+		}()
 	}
-}
 
-func getOrganizationMetrics(orgID string) []byte {
-	const organizationsEndpoint string = "https://anypoint.mulesoft.com/accounts/api/organizations/"
-	requestURL := fmt.Sprintf("%s%s", organizationsEndpoint, orgID)
+	send(nil)
+	pending := 1
+	timer := time.NewTimer(t.after)
+	defer timer.Stop()
 
-	client := &http.Client{}
+	for {
+		select {
+		case <-timer.C:
+			if atomic.AddInt64(&t.budget, -1) < 0 {
+				continue
+			}
+			if (t.slots != nil) && !t.slots.TryAcquireSlot() {
+				// Every slot is busy, so this request goes without; the budget is kept for another.
+				atomic.AddInt64(&t.budget, 1)
+				continue
+			}
+			atomic.AddUint64(&hedgedRequests, 1)
+			var release func()
+			if t.slots != nil {
+				release = sync.OnceFunc(t.slots.ReleaseSlot)
+			}
+			send(release)
+			pending++
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				cancels[r.attempt]()
+				if pending > 0 {
+					continue
+				}
+				return nil, r.err
+			}
 
-	req, err := http.NewRequest("GET", requestURL, nil)
-	errorCheck(err)
-	req.SetBasicAuth(*username, *password)
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
+			// Cancel the loser and discard whatever it manages to return.
+			if pending > 0 {
+				for i, cancel := range cancels {
+					if i != r.attempt {
+						cancel()
+					}
+				}
+				go func() {
+					if loser := <-results; loser.resp != nil {
+						loser.resp.Body.Close()
+					}
+				}()
+			}
+			r.resp.Body = cancelOnClose{r.resp.Body, cancels[r.attempt]}
+			return r.resp, nil
+		}
+	}
+}
 
-	resp, err := client.Do(req)
-	errorCheck(err)
-	defer resp.Body.Close()
+// clientOptions configures the HTTP client shared by every request.
+type clientOptions struct {
+	ReadOnly    bool          // Only let GETs and the allowedWrites table through
+	Pins        []string      // Base64 SPKI SHA-256 hashes, at least one of which must be presented
+	HedgeAfter  time.Duration // Hedge GETs slower than this; zero disables hedging
+	HedgeBudget int64         // Maximum number of hedged requests per run
+	Slots       slotPool      // Where hedges take their concurrency slots from
+}
 
-	if resp.StatusCode != http.StatusOK {
-		fmt.Println("Non-OK HTTP status:", resp.StatusCode)
+// newHTTPClient builds the client shared by every request.
+func newHTTPClient(opts clientOptions) (*http.Client, error) {
+	var transport http.RoundTripper = http.DefaultTransport
+	if len(opts.Pins) > 0 {
+		for _, pin := range opts.Pins {
+			if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid -pin-sha256 %q: want a base64 SHA-256 hash", pin)
+			}
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{VerifyConnection: verifyPins(opts.Pins)}
+		transport = t
+	}
+	if opts.HedgeAfter > 0 {
+		transport = &hedgedTransport{next: transport, after: opts.HedgeAfter, budget: opts.HedgeBudget, slots: opts.Slots}
 	}
+	if opts.ReadOnly {
+		transport = &readOnlyTransport{next: transport}
+	}
+	return &http.Client{Transport: transport}, nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	errorCheck(err)
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
 
-	return body
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-func getDeployedArtifacts(environment string) []byte {
-	const organizationsEndpoint string = "https://anypoint.mulesoft.com/cloudhub/api/v2/applications"
+// Set implements flag.Value.
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
 
-	client := &http.Client{}
+// values splits every occurrence on commas, dropping blanks.
+func (l stringList) values() []string {
+	var values []string
+	for _, list := range l {
+		for _, v := range strings.Split(list, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
 
-	req, err := http.NewRequest("GET", organizationsEndpoint, nil)
-	errorCheck(err)
-	req.SetBasicAuth(*username, *password)
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-anypnt-env-id", environment)
+// controlPlaneFlags defines -region and -baseurl, with its -base-url alias, on fs.
+func controlPlaneFlags(fs *flag.FlagSet) (region, baseURL *string) {
+	region = fs.String("region", "", "The Anypoint control plane to use: us, eu, gov, or custom with -baseurl.  Defaults to us.")
+	baseURL = fs.String("baseurl", "", "The base URL of the control plane for -region custom, e.g. https://anypoint.example.com.")
+	fs.StringVar(baseURL, "base-url", "", "Alias for -baseurl.")
+	return region, baseURL
+}
 
-	resp, err := client.Do(req)
-	errorCheck(err)
-	defer resp.Body.Close()
+// resolveBaseURL picks the control plane from -region and -baseurl.  A -baseurl without -region
+// implies custom, as it did before -region existed.
+func resolveBaseURL(region, baseURL string) (string, error) {
+	switch region {
+	case "":
+		if baseURL != "" {
+			return baseURL, nil
+		}
+		return tree.DefaultBaseURL, nil
+	case "custom":
+		if baseURL == "" {
+			return "", errors.New("-region custom needs -baseurl")
+		}
+		return baseURL, nil
+	}
+
+	u, ok := tree.Regions[region]
+	if !ok {
+		return "", fmt.Errorf("unknown -region %q, want us, eu, gov, or custom", region)
+	}
+	if baseURL != "" {
+		return "", fmt.Errorf("-baseurl can only be used with -region custom, not %s", region)
+	}
+	return u, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		fmt.Println("Non-OK HTTP status:", resp.StatusCode)
-		os.Exit(1)
+// checkBaseURL validates -baseurl as an absolute https URL naming only a host, since the paths of
+// every endpoint, and of the allowedWrites table, are rooted at it.
+func checkBaseURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "https") || (u.Host == "") {
+		return fmt.Errorf("%q is not an absolute https URL", raw)
+	}
+	if strings.Trim(u.Path, "/") != "" || (u.RawQuery != "") || (u.Fragment != "") {
+		return fmt.Errorf("%q must name only the control plane host", raw)
 	}
+	return nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	errorCheck(err)
+// credential is a username or password along with where it was found.  When the value is empty,
+// source lists every place that was consulted, for the missing-credential error.
+type credential struct {
+	value  string
+	source string
+	flag   bool // Given on the command line, rather than found in the environment or a prompt
+}
 
-	return body
+// resolveCredential prefers the flag, then the environment variable.  Keeping the password out of
+// the command line keeps it out of shell history and ps.
+func resolveCredential(flagName, flagValue, envVar string) credential {
+	if flagValue != "" {
+		return credential{value: flagValue, source: "-" + flagName, flag: true}
+	}
+	if v := os.Getenv(envVar); v != "" {
+		return credential{value: v, source: envVar}
+	}
+	return credential{source: "-" + flagName + ", " + envVar}
 }
 
-func searchForArtifact(p *Node, domain string, g *sync.WaitGroup) {
-	defer g.Done()
-	// First check target node for deployed artifact
-	for _, environment := range p.BusinessOrganization.Environments {
-		byteArray := getDeployedArtifacts(environment.ID)
-		var applications []Application
-		json.Unmarshal(byteArray, &applications)
+// Shared between prompts so buffered input meant for the second one isn't lost.
+var stdin = bufio.NewReader(os.Stdin)
 
-		for _, app := range applications {
-			if app.Domain == domain {
-				fmt.Println("FOUND IT")
-				fmt.Printf("%s", string(byteArray))
+// promptCredential fills in c from the terminal, with echo off when secret is set.  Without a
+// terminal on stdin it leaves c empty and notes that no prompt was possible.
+func promptCredential(c *credential, label string, secret bool) error {
+	// stty fails on anything but a terminal, including character devices like /dev/null.
+	if stty("-g") != nil {
+		c.source += ", prompt (stdin is not a terminal)"
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "%s: ", label)
+	if secret {
+		if err := stty("-echo"); err != nil {
+			return fmt.Errorf("cannot turn off echo for the %s prompt: %s", label, err)
+		}
+		// Don't leave the terminal silent if the prompt is interrupted.
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			if _, ok := <-sigs; ok {
+				stty("echo")
+				fmt.Fprintln(os.Stderr)
+				os.Exit(130)
 			}
+		}()
+		defer func() {
+			signal.Stop(sigs)
+			close(sigs)
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, err := stdin.ReadString('\n')
+	if (err != nil) && (err != io.EOF) {
+		return fmt.Errorf("reading the %s prompt: %s", label, err)
+	}
+	if c.value = strings.TrimRight(line, "\r\n"); c.value == "" {
+		c.source += ", prompt (nothing entered)"
+		return nil
+	}
+	c.source = "prompt"
+	return nil
+}
+
+// stty changes the mode of the terminal on stdin.  It stands in for a terminal package, which would
+// be a dependency for the sake of one prompt.
+func stty(mode string) error {
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+// selectAuthenticator picks the authentication method from the resolved credentials.  Exactly one
+// method must be given on the command line, and the paired values must be given together.  A
+// username and password from the environment or a prompt are only used when no flag picks a method.
+// A Connected App exchanges its credentials through client.
+func selectAuthenticator(token, clientID, clientSecret string, username, password credential, client *tree.Client) (tree.Authenticator, error) {
+	var chosen []string
+	var auth tree.Authenticator
+
+	if token != "" {
+		chosen = append(chosen, "-token")
+		auth = tree.StaticToken(token)
+	}
+	if (clientID != "") || (clientSecret != "") {
+		if (clientID == "") || (clientSecret == "") {
+			return nil, errors.New("-clientid and -clientsecret must be given together")
+		}
+		tokenURL, err := client.Endpoint(tree.TokenPath)
+		if err != nil {
+			return nil, err
 		}
+		chosen = append(chosen, "-clientid/-clientsecret")
+		auth = &tree.ClientCredentials{TokenURL: tokenURL, ClientID: clientID, ClientSecret: clientSecret, HTTPClient: client.HTTPClient, Warnf: client.Warnf}
+	}
+	fromFlags := username.flag || password.flag
+	if ((username.value != "") || (password.value != "")) && (fromFlags || (len(chosen) == 0)) {
+		switch {
+		case username.value == "":
+			return nil, fmt.Errorf("password from %s has no username: checked %s", password.source, username.source)
+		case password.value == "":
+			return nil, fmt.Errorf("username from %s has no password: checked %s", username.source, password.source)
+		}
+		chosen = append(chosen, "username/password")
+		auth = &tree.BasicAuth{Username: username.value, Password: password.value}
 	}
 
-	for _, v := range p.Children {
-		g.Add(1)
-		go searchForArtifact(v, domain, g)
+	switch len(chosen) {
+	case 0:
+		return nil, fmt.Errorf("no credentials given: use -clientid/-clientsecret, -token, or a username and password (checked %s; %s)", username.source, password.source)
+	case 1:
+		return auth, nil
+	default:
+		return nil, fmt.Errorf("more than one authentication method given (%s): use only one", strings.Join(chosen, ", "))
 	}
 }
 
-func generateApplications(p *Node, g *sync.WaitGroup) {
-	defer g.Done()
-	for _, environment := range p.BusinessOrganization.Environments {
-		byteArray := getDeployedArtifacts(environment.ID)
-		var applications []*Application
-		json.Unmarshal(byteArray, &applications)
+// Diagnostics go to the slog default logger on stderr, configured by -log-level and -log-format;
+// stdout is reserved for data written through output.  log.Logger issues a single Write per call, so
+// lines from concurrent goroutines never interleave.
+var output = log.New(os.Stdout, "", 0)
 
-		environment.Applications = applications
+// newLogHandler returns the slog handler for the -log-level and -log-format flags, writing to w.
+func newLogHandler(w io.Writer, level, format string) (slog.Handler, error) {
+	var l slog.Level
+	switch level {
+	case "debug":
+		l = slog.LevelDebug
+	case "info":
+		l = slog.LevelInfo
+	case "warn":
+		l = slog.LevelWarn
+	case "error":
+		l = slog.LevelError
+	default:
+		return nil, fmt.Errorf("unknown -log-level %q, want debug, info, warn, or error", level)
 	}
 
-	for _, c := range p.Children {
-		g.Add(1)
-		go generateApplications(c, g)
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("unknown -log-format %q, want text or json", format)
 	}
 }
 
-func flattenTree(p *Node, orgMap map[string]Organization) {
-	orgMap[p.BusinessOrganization.Name] = p.BusinessOrganization
+// The warning categories raised by the CLI itself, alongside the ones raised by package tree.  Both
+// are selected by -suppress-warnings and -warnings-as-errors.  W005 is retired: it flagged every
+// -format csv run, which the user had asked for, and codes are never reused.
+const (
+	warnLivenessFile   tree.WarningCode = "W003"
+	warnMemoryPressure tree.WarningCode = "W004"
+)
+
+// warningNames is the registry of every warning category, by code.
+var warningNames = map[tree.WarningCode]string{
+	tree.WarnNonNumeric:   "non-numeric-field",
+	tree.WarnDuplicateOrg: "duplicate-org",
+	warnLivenessFile:      "liveness-file",
+	warnMemoryPressure:    "memory-pressure",
+	tree.WarnRetry:        "http-retry",
+	tree.WarnRepeatedPage: "repeated-page",
+}
+
+// warningLog counts the warnings raised during a run and decides which are logged.
+type warningLog struct {
+	mux       sync.Mutex // For locking counts
+	counts    map[tree.WarningCode]int
+	suppress  map[tree.WarningCode]bool
+	escalated map[tree.WarningCode]bool
+}
 
-	for _, c := range p.Children {
-		flattenTree(c, orgMap)
+// Configured in main from -suppress-warnings and -warnings-as-errors.
+var warnings = &warningLog{}
+
+// parseWarningCodes parses a comma-separated list of codes, rejecting any not in warningNames.
+func parseWarningCodes(list string) (map[tree.WarningCode]bool, error) {
+	codes := make(map[tree.WarningCode]bool)
+	for _, c := range strings.Split(list, ",") {
+		code := tree.WarningCode(strings.ToUpper(strings.TrimSpace(c)))
+		if code == "" {
+			continue
+		}
+		if _, ok := warningNames[code]; !ok {
+			return nil, fmt.Errorf("unknown warning code %q", c)
+		}
+		codes[code] = true
 	}
+	return codes, nil
 }
 
-func writeMetricsFile(data interface{}, filename string) (int, error) {
-	b, err := json.MarshalIndent(data, "", "    ")
+// warnf records a warning under code and logs it unless the category is suppressed.  Suppressed
+// warnings are still counted in the summary.
+func warnf(code tree.WarningCode, format string, args ...interface{}) {
+	warnings.mux.Lock()
+	if warnings.counts == nil {
+		warnings.counts = make(map[tree.WarningCode]int)
+	}
+	warnings.counts[code]++
+	suppressed := warnings.suppress[code]
+	warnings.mux.Unlock()
+
+	if !suppressed {
+		slog.Warn(fmt.Sprintf(format, args...), "code", code, "warning", warningNames[code])
+	}
+}
+
+// summarize logs the number of warnings in each category and reports whether any was in a category
+// given to -warnings-as-errors.
+func (l *warningLog) summarize() (failed bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	var codes []string
+	for code := range l.counts {
+		codes = append(codes, string(code))
+	}
+	sort.Strings(codes)
+	for _, c := range codes {
+		code := tree.WarningCode(c)
+		attrs := []interface{}{"code", code, "warning", warningNames[code], "count", l.counts[code]}
+		switch {
+		case l.escalated[code]:
+			attrs = append(attrs, "treated_as_error", true)
+			failed = true
+		case l.suppress[code]:
+			attrs = append(attrs, "suppressed", true)
+		}
+		slog.Info("warnings raised", attrs...)
+	}
+	return failed
+}
+
+// csvHeader names the columns written by WriteMetricsCSV.
+var csvHeader = []string{
+	"RootOrgID", "OrgName", "OrgID", "EnvironmentName", "EnvironmentID", "AppDomain", "AppFullDomain", "Status",
+	"FileName", "WorkerType", "WorkerAmount", "MuleVersion", "LastUpdateTime",
+}
+
+// WriteMetricsCSV writes one row per application to filename, returning the number of bytes written.
+// Rows are sorted by root, organization, environment, then domain so that repeated runs diff cleanly.
+func WriteMetricsCSV(data []tree.FlatApplication, filename string) (int, error) {
+	rows := append([]tree.FlatApplication(nil), data...)
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.RootOrgID != b.RootOrgID {
+			return a.RootOrgID < b.RootOrgID
+		}
+		if a.OrgName != b.OrgName {
+			return a.OrgName < b.OrgName
+		}
+		if a.EnvironmentName != b.EnvironmentName {
+			return a.EnvironmentName < b.EnvironmentName
+		}
+		return a.Domain < b.Domain
+	})
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(csvHeader)
+	for _, app := range rows {
+		amount := ""
+		if n, ok := app.WorkerAmount(); ok {
+			amount = strconv.FormatInt(n, 10)
+		}
+		w.Write([]string{
+			app.RootOrgID,
+			app.OrgName,
+			app.OrgID,
+			app.EnvironmentName,
+			app.EnvironmentID,
+			app.Domain,
+			app.FullDomain,
+			app.Status,
+			app.FileName,
+			app.Workers.Type.CPU,
+			amount,
+			app.MuleVersion.Version,
+			app.LastUpdated,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return -1, err
+	}
+
+	f, err := os.Create(filename)
 	if err != nil {
 		return -1, err
 	}
+	defer f.Close()
+
+	return f.Write(buf.Bytes())
+}
+
+// Encoder serializes the metrics for writeMetricsFile.
+type Encoder interface {
+	Encode(v interface{}, w io.Writer) error
+}
+
+// encoders maps each -format other than csv to its Encoder, which also names the file extension.
+var encoders = map[string]Encoder{
+	"json": jsonEncoder{},
+	"yaml": yamlEncoder{},
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) Encode(v interface{}, w io.Writer) error {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// yamlEncoder writes YAML with yaml.v3 by way of the JSON encoding, so field names, order, and
+// omitempty match the JSON output without a yaml tag on every field.
+type yamlEncoder struct{}
+
+func (yamlEncoder) Encode(v interface{}, w io.Writer) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// JSON is YAML, and a yaml.Node keeps the keys in the order they were written.
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	restyleYAML(&doc)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// restyleYAML drops the quoting and flow style n and its children were parsed with, so yaml.v3 quotes
+// only the strings that need it.  Two fixes keep the output readable by YAML 1.1 parsers as well:
+// strings such as yes and on, which they take for booleans, stay quoted, and an exponent float, which
+// JSON writes as 1e+21, gets the decimal point they need to read it as a number.
+func restyleYAML(n *yaml.Node) {
+	n.Style = 0
+	switch {
+	case n.Kind != yaml.ScalarNode:
+	case n.Tag == "!!str" && yaml11Bools[strings.ToLower(n.Value)]:
+		n.Style = yaml.DoubleQuotedStyle
+	case n.Tag == "!!float" && !strings.Contains(n.Value, "."):
+		if i := strings.IndexAny(n.Value, "eE"); i >= 0 {
+			n.Value = n.Value[:i] + ".0" + n.Value[i:]
+		}
+	}
+	for _, c := range n.Content {
+		restyleYAML(c)
+	}
+}
+
+// yaml11Bools are the booleans of YAML 1.1 that YAML 1.2 reads as plain strings.
+var yaml11Bools = map[string]bool{"y": true, "n": true, "yes": true, "no": true, "on": true, "off": true}
+
+func writeMetricsFile(enc Encoder, data interface{}, filename string) (int, error) {
+	var buf bytes.Buffer
+	if err := enc.Encode(data, &buf); err != nil {
+		return -1, err
+	}
 
 	f, err := os.Create(filename)
 	if err != nil {
@@ -209,43 +703,959 @@ func writeMetricsFile(data interface{}, filename string) (int, error) {
 	}
 	defer f.Close()
 
-	return f.Write(b)
+	return f.Write(buf.Bytes())
+}
+
+// heartbeatInterval is how often watchdog checks progress and memory use.  It's a variable so tests
+// don't wait on it.
+var heartbeatInterval = 10 * time.Second
+
+// memoryInUse reports the heap memory the run is holding.  It's a variable so memory pressure can be
+// simulated.
+var memoryInUse = func() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse
+}
+
+// watchdog runs until ctx is done.  Every heartbeat it touches livenessFile if client completed any
+// request since the last one, so a liveness probe on the file's age detects a hung run.  With a
+// memoryBudget it logs memory use, and the first time use crosses 80% of the budget it halves
+// client's concurrency.
+func watchdog(ctx context.Context, client *tree.Client, livenessFile string, memoryBudget uint64) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	lastProgress := ^uint64(0)
+	degraded := false
+	for {
+		if livenessFile != "" {
+			if n := client.RequestsCompleted(); n != lastProgress {
+				lastProgress = n
+				if err := touch(livenessFile); err != nil {
+					warnf(warnLivenessFile, "%s", err)
+				}
+			}
+		}
+
+		if memoryBudget > 0 {
+			used := memoryInUse()
+			slog.Info("memory use", "in_use_mib", used>>20, "budget_mib", memoryBudget>>20)
+			if !degraded && used >= memoryBudget/10*8 {
+				degraded = true
+				concurrency := client.Concurrency()
+				if reserved := (concurrency - 1) / 2; reserved > 0 {
+					warnf(warnMemoryPressure, "memory use above 80%% of budget, reducing concurrency from %d to %d", concurrency, concurrency-reserved)
+					go client.ReserveSlots(ctx, reserved)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func touch(path string) error {
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// parseSize parses a byte count such as 512Mi, 2GB, or 1048576.  Suffixes are binary multiples.
+func parseSize(s string) (uint64, error) {
+	units := []struct {
+		suffixes []string
+		shift    uint
+	}{
+		{[]string{"GIB", "GI", "GB", "G"}, 30},
+		{[]string{"MIB", "MI", "MB", "M"}, 20},
+		{[]string{"KIB", "KI", "KB", "K"}, 10},
+		{[]string{"B"}, 0},
+	}
+
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	for _, unit := range units {
+		for _, suffix := range unit.suffixes {
+			if strings.HasSuffix(upper, suffix) {
+				n, err := strconv.ParseUint(strings.TrimSpace(strings.TrimSuffix(upper, suffix)), 10, 64)
+				if err != nil {
+					return 0, fmt.Errorf("invalid size %q", s)
+				}
+				return n << unit.shift, nil
+			}
+		}
+	}
+
+	n, err := strconv.ParseUint(upper, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n, nil
+}
+
+// exitNotFound is the exit code of a -search run that found no matching application.
+const exitNotFound = 2
+
+// exitDifferent is the exit code of a -diff run that found differences.
+const exitDifferent = 2
+
+// exitUnhealthy is the exit code of a -strict run that found applications not in a healthy status.
+const exitUnhealthy = 2
+
+// completeMarker is written into the output directory once every artifact of a run is in place.  Its
+// first line is the run ID, and each line after that names one of the run's artifacts.
+const completeMarker = "COMPLETE"
+
+// partialFile is where a cancelled run writes the tree fetched so far, in the output directory.
+const partialFile = "metrics_partial.json"
+
+// rename and symlink are os.Rename and os.Symlink, replaced by tests to fail a commit part way.
+var (
+	rename  = os.Rename
+	symlink = os.Symlink
+)
+
+// runArtifacts lists every file name a run can write into the output directory, in any format.
+func runArtifacts() []string {
+	var formats []string
+	for format := range encoders {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+
+	var names []string
+	for _, format := range formats {
+		names = append(names, "metrics."+format, "metrics_flat."+format)
+	}
+	return append(names, "metrics_flat.csv", "stale_apps.json", "explain.json", renderFile, partialFile)
+}
+
+// maxStagingBytes caps the space taken by the staging directories failed runs leave behind.
+const maxStagingBytes = 100 << 20
+
+// stageRun creates the directory a run writes its artifacts into before commitRun moves them into
+// outdir.  A staging directory left behind belongs to a run that failed before committing, and is
+// kept for debugging until pruneStaging makes room under maxStagingBytes.
+func stageRun(outdir, runID string) (string, error) {
+	if err := pruneStaging(outdir, maxStagingBytes); err != nil {
+		return "", err
+	}
+	staging := filepath.Join(outdir, ".staging-"+runID)
+	return staging, os.MkdirAll(staging, 0755)
+}
+
+// pruneStaging removes the oldest staging directories in outdir until the rest take no more than
+// limit bytes.
+func pruneStaging(outdir string, limit int64) error {
+	entries, err := ioutil.ReadDir(outdir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var dirs []os.FileInfo
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), ".staging-") {
+			dirs = append(dirs, e)
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].ModTime().After(dirs[j].ModTime()) })
+
+	var total int64
+	for _, dir := range dirs {
+		path := filepath.Join(outdir, dir.Name())
+		err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+			if (err == nil) && !info.IsDir() {
+				total += info.Size()
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if total > limit {
+			slog.Debug("removing old staging directory", "dir", path)
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// commitRun moves the staged artifacts into outdir and then writes the COMPLETE marker.  The old
+// marker is removed first, along with every artifact an earlier run may have left that this one
+// doesn't replace, so a consumer keying on the marker never picks up a mix of two runs.  With
+// versioned set, the staging directory becomes outdir/<runID> and outdir/current is swapped to it
+// with a single rename.  current is a symlink where the platform allows one, and otherwise a file
+// holding the run ID.
+func commitRun(outdir, staging, runID string, versioned bool) error {
+	entries, err := ioutil.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	if versioned {
+		if err := writeCompleteMarker(staging, runID, names); err != nil {
+			return err
+		}
+		if err := rename(staging, filepath.Join(outdir, runID)); err != nil {
+			return err
+		}
+		pointer := filepath.Join(outdir, ".current-"+runID)
+		if err := symlink(runID, pointer); err != nil {
+			// Creating symlinks needs a privilege on Windows.
+			slog.Debug("symlink failed, writing current as a file", "err", err)
+			if err := ioutil.WriteFile(pointer, []byte(runID+"\n"), 0644); err != nil {
+				return err
+			}
+		}
+		return rename(pointer, filepath.Join(outdir, "current"))
+	}
+
+	err = os.Remove(filepath.Join(outdir, completeMarker))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range runArtifacts() {
+		err := os.Remove(filepath.Join(outdir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		if err := rename(filepath.Join(staging, name), filepath.Join(outdir, name)); err != nil {
+			return err
+		}
+	}
+
+	if err := writeCompleteMarker(outdir, runID, names); err != nil {
+		return err
+	}
+	return os.Remove(staging)
+}
+
+// writeCompleteMarker writes the COMPLETE marker of the run into dir, naming its artifacts.  It's
+// renamed into place, so the marker is never seen half written.
+func writeCompleteMarker(dir, runID string, names []string) error {
+	tmp := filepath.Join(dir, "."+completeMarker+"-"+runID)
+	content := strings.Join(append([]string{runID}, names...), "\n") + "\n"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	return rename(tmp, filepath.Join(dir, completeMarker))
+}
+
+// failureSummary lists the organizations and environments marked as failed in the trees, or returns
+// "" if there were none.
+func failureSummary(heads []*tree.Node) string {
+	var orgs, envs []string
+	var walk func(p *tree.Node)
+	walk = func(p *tree.Node) {
+		if p.Error != "" {
+			orgs = append(orgs, p.BusinessOrganization.ID)
+		}
+		for _, environment := range p.BusinessOrganization.Environments {
+			if environment.Error != "" {
+				envs = append(envs, environment.ID)
+			}
+		}
+		for _, c := range p.Children {
+			walk(c)
+		}
+	}
+	for _, head := range heads {
+		walk(head)
+	}
+
+	var parts []string
+	if len(orgs) > 0 {
+		sort.Strings(orgs)
+		parts = append(parts, fmt.Sprintf("%d organization(s) [%s]", len(orgs), strings.Join(orgs, ", ")))
+	}
+	if len(envs) > 0 {
+		sort.Strings(envs)
+		parts = append(parts, fmt.Sprintf("%d environment(s) [%s]", len(envs), strings.Join(envs, ", ")))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "failed to load " + strings.Join(parts, " and ")
+}
+
+// forest is what metrics.json holds: the tree itself for a single root, so that existing consumers
+// keep working, otherwise an array of the trees.
+func forest(heads []*tree.Node) interface{} {
+	if len(heads) == 1 {
+		return heads[0]
+	}
+	return heads
+}
+
+// writePartial writes the trees of a cancelled run to filename, through a temporary file so an
+// interrupted write leaves nothing behind.
+func writePartial(heads []*tree.Node, filename string) error {
+	tmp := filename + ".tmp"
+	if _, err := writeMetricsFile(jsonEncoder{}, forest(heads), tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// staleReport is the content of stale_apps.json.
+type staleReport struct {
+	Now           string // When the run started, which ages are measured from
+	StaleDays     int
+	Organizations []tree.StaleOrganization
+}
+
+// unhealthyApplications returns the applications whose Status isn't one of healthy, compared
+// case-insensitively.
+func unhealthyApplications(apps []tree.FlatApplication, healthy []string) []tree.FlatApplication {
+	var unhealthy []tree.FlatApplication
+	for _, app := range apps {
+		ok := false
+		for _, status := range healthy {
+			if strings.EqualFold(app.Status, status) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			unhealthy = append(unhealthy, app)
+		}
+	}
+	return unhealthy
+}
+
+// exitStatus is the exit status of a run once its outputs are committed.  A run that failed, or whose
+// warnings count as errors, exits 1 whatever -strict found, since part of the estate may not have been
+// checked.  Otherwise any unhealthy applications are logged and the run exits exitUnhealthy.
+func exitStatus(failed bool, unhealthy []tree.FlatApplication) int {
+	if failed {
+		return 1
+	}
+	if len(unhealthy) == 0 {
+		return 0
+	}
+	for _, app := range unhealthy {
+		slog.Error("unhealthy application", "domain", app.Domain, "status", app.Status,
+			"org", app.OrgID, "environment", app.EnvironmentID)
+	}
+	slog.Error("applications not in a healthy status", "count", len(unhealthy), "exit", exitUnhealthy)
+	return exitUnhealthy
+}
+
+// stageOutput is the Stage of the Decisions -explain adds for whatever made it into the output.
+const stageOutput = "output"
+
+// stageOrder ranks the stages of the pipeline in the order they run.
+var stageOrder = map[string]int{
+	tree.StageBuild:        0,
+	tree.StageEnvironments: 1,
+	tree.StageFetch:        2,
+	tree.StageStatus:       3,
+	stageOutput:            4,
+}
+
+// explainLog collects the Decisions for -explain about one application domain or organization ID.
+type explainLog struct {
+	mux       sync.Mutex // For locking decisions
+	target    string
+	decisions []tree.Decision
+}
+
+// record keeps d if it concerns the target, or is about an organization or environment whose
+// applications aren't known, which the target may have been in.
+func (l *explainLog) record(d tree.Decision) {
+	if (d.Domain != "") && (d.Domain != l.target) && (d.OrgID != l.target) {
+		return
+	}
+	l.mux.Lock()
+	l.decisions = append(l.decisions, d)
+	l.mux.Unlock()
+}
+
+// finish adds where the target ended up in the output, and returns every decision ordered by stage.
+// A target that's the ID of an organization in the output is reported as that organization, with
+// only the decisions about it.
+func (l *explainLog) finish(heads []*tree.Node) []tree.Decision {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if org := findOrg(heads, l.target); org != nil {
+		var decisions []tree.Decision
+		for _, d := range l.decisions {
+			if d.OrgID == l.target {
+				decisions = append(decisions, d)
+			}
+		}
+		decisions = append(decisions, orgOutcome(org))
+		sort.SliceStable(decisions, func(i, j int) bool {
+			return stageOrder[decisions[i].Stage] < stageOrder[decisions[j].Stage]
+		})
+		return decisions
+	}
+
+	found := false
+	for _, head := range heads {
+		for _, r := range tree.SearchForArtifact(head, l.target) {
+			found = true
+			l.decisions = append(l.decisions, tree.Decision{
+				Stage:           stageOutput,
+				Outcome:         "kept",
+				OrgID:           r.OrganizationID,
+				OrgName:         r.OrganizationName,
+				EnvironmentID:   r.EnvironmentID,
+				EnvironmentName: r.EnvironmentName,
+				Domain:          l.target,
+				Reason:          "written to the output",
+			})
+		}
+	}
+	if !found {
+		l.decisions = append(l.decisions, tree.Decision{
+			Stage:   stageOutput,
+			Outcome: "excluded",
+			Domain:  l.target,
+			Reason:  "no application with this domain, or organization with this ID, is in the output",
+		})
+	}
+
+	decisions := append([]tree.Decision{}, l.decisions...)
+	sort.SliceStable(decisions, func(i, j int) bool {
+		return stageOrder[decisions[i].Stage] < stageOrder[decisions[j].Stage]
+	})
+	return decisions
+}
+
+// orgOutcome is the output Decision for an organization -explain found in the output.
+func orgOutcome(org *tree.Node) tree.Decision {
+	d := tree.Decision{
+		Stage:   stageOutput,
+		Outcome: "kept",
+		OrgID:   org.BusinessOrganization.ID,
+		OrgName: org.BusinessOrganization.Name,
+	}
+	if org.Error != "" {
+		d.Outcome = "failed"
+		d.Reason = "written to the output marked as failed: " + org.Error
+		return d
+	}
+
+	var environments, skipped, failed, apps int
+	for _, environment := range org.BusinessOrganization.Environments {
+		switch {
+		case environment.Skipped:
+			skipped++
+		case environment.Error != "":
+			failed++
+		default:
+			environments++
+			apps += len(environment.Applications)
+		}
+	}
+	d.Reason = fmt.Sprintf("written to the output with %d applications in %d environments, %d skipped and %d failed, and %d sub-organizations",
+		apps, environments, skipped, failed, len(org.Children))
+	return d
+}
+
+// findOrg returns the organization with the given ID in any of heads, or nil if there's none.
+func findOrg(heads []*tree.Node, id string) *tree.Node {
+	for _, p := range heads {
+		if p.BusinessOrganization.ID == id {
+			return p
+		}
+		if found := findOrg(p.Children, id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// runDiff compares the metrics.json files named by args, the old snapshot then the new, printing the
+// differences to stdout and writing them to diff.json in outdir.
+func runDiff(args []string, outdir string) (int, error) {
+	if len(args) != 2 {
+		return 1, errors.New("-diff wants two files, the old metrics.json then the new one")
+	}
+	old, err := tree.LoadForest(args[0])
+	if err != nil {
+		return 1, err
+	}
+	current, err := tree.LoadForest(args[1])
+	if err != nil {
+		return 1, err
+	}
+
+	diff := tree.DiffForests(old, current)
+	tree.PrintDiff(diff, output.Writer())
+	bytes, err := writeMetricsFile(jsonEncoder{}, diff, filepath.Join(outdir, "diff.json"))
+	if err != nil {
+		return 1, err
+	}
+	slog.Info("wrote diff", "file", "diff.json", "bytes", bytes)
+
+	if !diff.Empty() {
+		return exitDifferent, nil
+	}
+	return 0, nil
+}
+
+// renderFile is where -render dot writes the graph, in the output directory.
+const renderFile = "organizations.dot"
+
+// render draws the organization hierarchy of heads for -render: as DOT into dir, or as ASCII to stdout.
+func render(heads []*tree.Node, format, dir string) error {
+	if format == "ascii" {
+		return tree.RenderASCII(heads, output.Writer())
+	}
+
+	var buf bytes.Buffer
+	if err := tree.RenderDOT(heads, &buf); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, renderFile), buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	slog.Info("wrote organization graph", "file", renderFile, "bytes", buf.Len())
+	return nil
+}
+
+// runRender draws the trees saved in a metrics.json for -render-from, without fetching anything.
+func runRender(path, format, outdir string) (int, error) {
+	heads, err := tree.LoadForest(path)
+	if err != nil {
+		return 1, err
+	}
+	for _, head := range heads {
+		tree.ComputeUsage(head)
+		head.Normalize()
+	}
+	if err := render(heads, format, outdir); err != nil {
+		return 1, err
+	}
+	return 0, nil
 }
 
 func main() {
-	g := &sync.WaitGroup{}
-	rootID = flag.String("rootid", "", "The ID for the tree's root organization.")
-	username = flag.String("username", "", "The username for the Cloudhub account with access to the target Enterprise.")
-	password = flag.String("password", "", "The password for the Cloudhub account with access to the target Enterprise.")
+	code, err := run()
+	if err != nil {
+		slog.Error(err.Error())
+	}
+	os.Exit(code)
+}
+
+// run carries out the command and returns its exit status, along with the error that caused it.
+func run() (int, error) {
+	// Every time-relative result of the run is computed against this one instant.
+	started := time.Now().UTC()
+
+	var rootIDs stringList
+	flag.Var(&rootIDs, "rootid", "The ID for the tree's root organization.  Repeat or separate with commas to build one tree per root.")
+	username := flag.String("username", "", "The username for the Cloudhub account with access to the target Enterprise.  Defaults to $ANYPOINT_USERNAME, then a prompt.")
+	password := flag.String("password", "", "The password for the Cloudhub account with access to the target Enterprise.  Defaults to $ANYPOINT_PASSWORD, then a prompt.")
+	token := flag.String("token", "", "A bearer token to authenticate with instead of a username and password.")
+	clientID := flag.String("clientid", "", "The client ID of a Connected App to authenticate with instead of a username and password.")
+	clientSecret := flag.String("clientsecret", "", "The client secret of the Connected App given by -clientid.")
+	region, baseURL := controlPlaneFlags(flag.CommandLine)
 	outdir := flag.String("outdir", ".", "The directory to write the output files to.  Defaults to the bin's current directory.")
+	versioned := flag.Bool("versioned-outdir", false, "Write each run into its own directory under outdir and point outdir/current at the latest complete run.")
+	var pins stringList
+	flag.Var(&pins, "pin-sha256", "A base64 SHA-256 hash of an accepted server SPKI.  Repeat to allow several pins during rotation.")
+	hedgeAfter := flag.Duration("hedge-after", 0, "Send one duplicate of any GET still outstanding after this long, keeping whichever answers first, when there is a -max-concurrent slot free for it.  Disabled by default.")
+	hedgeBudget := flag.Int64("hedge-budget", 20, "The maximum number of hedged requests per run.")
+	maxRetries := flag.Int("retries", tree.DefaultMaxRetries, "The number of times to retry a request that failed with HTTP 429 or a 5xx status.")
+	flag.IntVar(maxRetries, "max-retries", tree.DefaultMaxRetries, "Alias for -retries.")
+	depth := flag.Int("depth", -1, "The number of levels of sub-organizations to fetch below the root.  0 fetches the root only; -1, the default, fetches them all.")
+	pageSize := flag.Int("page-size", tree.DefaultPageSize, "The number of applications to request per page.")
+	maxConcurrent := flag.Int("max-concurrent", 10, "The maximum number of organizations or environments fetched at once.")
+	flag.IntVar(maxConcurrent, "concurrency", 10, "Alias for -max-concurrent.")
+	format := flag.String("format", "json", "The output format, json, yaml, or csv.  csv writes the flat application list only.")
+	livenessFile := flag.String("liveness-file", "", "A file touched on every heartbeat in which requests completed, for a liveness probe to check the age of.")
+	memoryBudget := flag.String("memory-budget", "", "The memory the run may use, e.g. 512Mi.  Concurrency is halved past 80% of it.  Defaults to GOMEMLIMIT when that is set.")
+	suppressWarnings := flag.String("suppress-warnings", "", "A comma-separated list of warning codes, e.g. W002,W006, to count but not log.")
+	warningsAsErrors := flag.String("warnings-as-errors", "", "A comma-separated list of warning codes that fail the run, with exit status 1, if raised.")
+	fromFile := flag.String("from-file", "", "Load the tree from a metrics.json written by an earlier run instead of fetching it.  Applications are fetched only if the file has none.")
+	retryFrom := flag.String("retry-from", "", "Load the tree from a metrics.json or metrics_partial.json written by an earlier run and fetch only the orgs and environments that failed or were never reached.")
+	var statuses stringList
+	flag.Var(&statuses, "status", "Only keep applications in this status, e.g. STOPPED.  Repeat or separate with commas to keep several.")
+	var envs, envTypes stringList
+	flag.Var(&envs, "env", "Only fetch and search the environments with this name, compared case-insensitively, or ID.  Repeat or separate with commas to keep several.  Other environments are kept in the output marked \"Skipped\": true.")
+	flag.Var(&envTypes, "env-type", "Only fetch and search the environments of this type, e.g. production or sandbox.  Repeat or separate with commas to keep several.")
+	timeout := flag.Duration("timeout", 0, "Cancel the run after this long, writing the tree fetched so far to metrics_partial.json.  Disabled by default.")
+	staleDays := flag.Int("stale-days", 0, "Also write stale_apps.json, listing every application last updated more than this many days before the run started.  Disabled by default.")
+	strict := flag.Bool("strict", false, "Exit 2 once the metrics files are written if any application is not in a healthy status, listing them on stderr.")
+	var healthy stringList
+	flag.Var(&healthy, "healthy-status", "A status -strict treats as healthy.  Repeat or separate with commas to allow several.  Defaults to STARTED.")
+	summary := flag.Bool("summary", false, "Print a table of each organization's own and subtree worker usage to stdout before writing the metrics files.")
+	printTree := flag.Bool("print", false, "Print the organization tree to stdout before writing the metrics files.")
+	search := flag.String("search", "", "Print every deployment of the application with this domain as JSON instead of writing the metrics files.")
+	enforceReadOnly := flag.Bool("enforce-read-only", true, "Reject any request that is not a GET or an allow-listed write.  Only meant to be disabled by a future write mode.")
+	explain := flag.String("explain", "", "Trace the application with this domain, or the organization with this ID, through the run, printing every decision that affected it to stdout and writing them to explain.json.")
+	diff := flag.Bool("diff", false, "Compare two metrics.json files given as arguments, the old then the new, instead of fetching.  Prints the differences, writes them to diff.json, and exits 2 if there are any.")
+	renderFormat := flag.String("render", "", "Also draw the organization hierarchy, as dot, a Graphviz graph written to organizations.dot, or ascii, an indented tree printed to stdout.")
+	renderFrom := flag.String("render-from", "", "Draw the hierarchy saved in a metrics.json, as given by -render, defaulting to ascii, instead of fetching.")
+	logLevel := flag.String("log-level", "info", "The least severe messages to log to stderr: debug, info, warn, or error.  debug logs every request.")
+	logFormat := flag.String("log-format", "text", "The format of the log on stderr, text or json.")
 	flag.Parse()
 
-	if (*rootID == "") || (*username == "") || (*password == "") {
-		fmt.Println("You are missing one or more flags.")
-		os.Exit(1)
+	handler, err := newLogHandler(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		return 1, err
+	}
+	slog.SetDefault(slog.New(handler))
+
+	if (*renderFormat != "") && (*renderFormat != "dot") && (*renderFormat != "ascii") {
+		return 1, fmt.Errorf("unknown -render %q, want dot or ascii", *renderFormat)
 	}
 
-	// Generate Organization hierarchy and write to file
-	head := InitTree()
+	if *diff {
+		return runDiff(flag.Args(), *outdir)
+	}
 
-	g.Add(1)
-	generateApplications(head, g)
-	g.Wait()
+	if *renderFrom != "" {
+		if *renderFormat == "" {
+			*renderFormat = "ascii"
+		}
+		return runRender(*renderFrom, *renderFormat, *outdir)
+	}
 
-	bytes, err := writeMetricsFile(head, *outdir+"/metrics.json")
-	errorCheck(err)
-	fmt.Printf("wrote %d bytes\n", bytes)
+	if (len(rootIDs.values()) == 0) && (*fromFile == "") && (*retryFrom == "") {
+		return 1, errors.New("missing -rootid, -from-file, or -retry-from")
+	}
 
-	// Flatten Organization hierarchy and write to file
-	orgMap := make(map[string]Organization)
-	flattenTree(head, orgMap)
-	values := []Organization{}
-	for _, value := range orgMap {
-		fmt.Println(value)
-		values = append(values, value)
+	if (*fromFile != "") && (*retryFrom != "") {
+		return 1, errors.New("-from-file and -retry-from can't be used together")
 	}
 
-	bytes, err = writeMetricsFile(values, *outdir+"/metrics_flat.json")
-	errorCheck(err)
-	fmt.Printf("wrote %d bytes\n", bytes)
+	if _, ok := encoders[*format]; !ok && (*format != "csv") {
+		return 1, fmt.Errorf("unknown -format %q, want json, yaml, or csv", *format)
+	}
+
+	if warnings.suppress, err = parseWarningCodes(*suppressWarnings); err != nil {
+		return 1, fmt.Errorf("-suppress-warnings: %s", err)
+	}
+	if warnings.escalated, err = parseWarningCodes(*warningsAsErrors); err != nil {
+		return 1, fmt.Errorf("-warnings-as-errors: %s", err)
+	}
+
+	controlPlane, err := resolveBaseURL(*region, *baseURL)
+	if err != nil {
+		return 1, err
+	}
+	if err := checkBaseURL(controlPlane); err != nil {
+		return 1, fmt.Errorf("-baseurl: %s", err)
+	}
+
+	if *maxRetries < 0 {
+		return 1, errors.New("-retries/-max-retries must not be negative")
+	}
+
+	if *depth < -1 {
+		return 1, errors.New("-depth must be -1 or more")
+	}
+
+	if *pageSize < 1 {
+		return 1, errors.New("-page-size must be at least 1")
+	}
+
+	if len(healthy) == 0 {
+		healthy = stringList{"STARTED"}
+	}
+
+	if *staleDays < 0 {
+		return 1, errors.New("-stale-days must not be negative")
+	}
+
+	if *maxConcurrent < 1 {
+		return 1, errors.New("-max-concurrent/-concurrency must be at least 1")
+	}
+
+	// A saved tree that already has its applications needs no requests, and so no credentials.
+	var heads []*tree.Node
+	if *fromFile != "" {
+		heads, err = tree.LoadForest(*fromFile)
+		if err != nil {
+			return 1, err
+		}
+	}
+	if *retryFrom != "" {
+		heads, err = tree.LoadForest(*retryFrom)
+		if err != nil {
+			return 1, err
+		}
+	}
+	online := (heads == nil) || (*retryFrom != "")
+	for _, head := range heads {
+		if !tree.HasApplications(head) {
+			online = true
+		}
+	}
+
+	client := tree.NewClient(nil, nil, *maxConcurrent)
+	client.BaseURL = controlPlane
+	client.MaxRetries = *maxRetries
+	client.PageSize = *pageSize
+	client.MaxDepth = *depth
+	client.Warnf = warnf
+	var trail *explainLog
+	if *explain != "" {
+		trail = &explainLog{target: *explain}
+		client.Explain = trail.record
+	}
+
+	if online {
+		client.HTTPClient, err = newHTTPClient(clientOptions{
+			ReadOnly:    *enforceReadOnly,
+			Pins:        pins,
+			HedgeAfter:  *hedgeAfter,
+			HedgeBudget: *hedgeBudget,
+			Slots:       client,
+		})
+		if err != nil {
+			return 1, err
+		}
+
+		user := resolveCredential("username", *username, "ANYPOINT_USERNAME")
+		pass := resolveCredential("password", *password, "ANYPOINT_PASSWORD")
+		// Only prompt when a username and password is the sole method left.
+		if (*token == "") && (*clientID == "") && (*clientSecret == "") {
+			if user.value == "" {
+				if err := promptCredential(&user, "Anypoint username", false); err != nil {
+					return 1, err
+				}
+			}
+			if pass.value == "" {
+				if err := promptCredential(&pass, "Anypoint password", true); err != nil {
+					return 1, err
+				}
+			}
+		}
+		client.Authenticator, err = selectAuthenticator(*token, *clientID, *clientSecret, user, pass, client)
+		if err != nil {
+			return 1, err
+		}
+	}
+
+	// Cancel in-flight requests on SIGINT or SIGTERM, or once -timeout has passed.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	var budget uint64
+	switch {
+	case *memoryBudget != "":
+		budget, err = parseSize(*memoryBudget)
+		if err != nil {
+			return 1, err
+		}
+	case os.Getenv("GOMEMLIMIT") != "":
+		// The runtime has already parsed it; a negative argument only reads the limit back.
+		budget = uint64(debug.SetMemoryLimit(-1))
+	}
+	if (*livenessFile != "") || (budget > 0) {
+		go watchdog(ctx, client, *livenessFile, budget)
+	}
+
+	// Fetch the Connected App token before building the tree, so bad credentials fail fast.
+	if cc, ok := client.Authenticator.(*tree.ClientCredentials); ok {
+		if err := cc.Login(ctx); err != nil {
+			return 1, err
+		}
+	}
+
+	// Generate Organization hierarchy and write to file.  Orgs and environments that failed are marked
+	// in the tree, which is still written, but the run exits non-zero.
+	failed := false
+	if heads == nil {
+		heads, err = client.InitForest(ctx, rootIDs.values())
+		if len(heads) == 0 {
+			return 1, err
+		}
+		if err != nil {
+			slog.Error("building the organization tree failed", "err", err)
+			failed = true
+		}
+	}
+
+	filter := tree.EnvironmentFilter{Names: envs.values(), Types: envTypes.values()}
+	for _, head := range heads {
+		client.SkipEnvironments(head, filter)
+		if *retryFrom != "" {
+			// Whatever the earlier run fetched is kept, so only its failures can fail again.
+			if err := client.RetryFailures(ctx, head); err != nil {
+				slog.Error("retrying failures failed", "org", head.BusinessOrganization.ID, "err", err)
+				failed = true
+			}
+		} else if online {
+			if err := client.GenerateApplications(ctx, head); err != nil {
+				slog.Error("fetching applications failed", "org", head.BusinessOrganization.ID, "err", err)
+				failed = true
+			}
+		}
+	}
+
+	keep := statuses.values()
+	for _, head := range heads {
+		client.FilterApplicationsByStatus(head, keep)
+		tree.ComputeUsage(head)
+		head.Normalize()
+	}
+
+	// A cancelled run has an incomplete tree, which mustn't replace the previous outputs, so it's
+	// written to metrics_partial.json on its own.
+	if ctx.Err() != nil {
+		// Let a second Ctrl-C kill the process outright.
+		stop()
+		reason := "interrupted"
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			reason = fmt.Sprintf("timed out after %s", *timeout)
+		}
+		partial := filepath.Join(*outdir, partialFile)
+		if err := writePartial(heads, partial); err != nil {
+			return 1, fmt.Errorf("%s, and writing the partial tree failed: %s", reason, err)
+		}
+		return 1, fmt.Errorf("%s, partial tree written to %s", reason, partial)
+	}
+
+	if *search != "" {
+		results := []tree.SearchResult{}
+		for _, head := range heads {
+			results = append(results, tree.SearchForArtifact(head, *search)...)
+		}
+		b, err := json.MarshalIndent(results, "", "    ")
+		if err != nil {
+			return 1, err
+		}
+		output.Print(string(b))
+
+		switch {
+		case warnings.summarize():
+			return 1, nil
+		case len(results) > 0:
+			return 0, nil
+		case failed:
+			// Part of the tree couldn't be fetched, so the domain may exist there.
+			return 1, fmt.Errorf("%s not found, but some environments failed to load", *search)
+		default:
+			slog.Info("not found", "domain", *search)
+			return exitNotFound, nil
+		}
+	}
+
+	for _, head := range heads {
+		if *printTree {
+			tree.PrintTree(head, output.Writer())
+		}
+		if *summary {
+			if err := tree.PrintUsage(head, output.Writer()); err != nil {
+				return 1, err
+			}
+		}
+	}
+
+	var decisions []tree.Decision
+	if trail != nil {
+		decisions = trail.finish(heads)
+		for _, d := range decisions {
+			output.Println(d)
+		}
+	}
+
+	runID := fmt.Sprintf("%s-%d", started.Format("20060102T150405Z"), os.Getpid())
+	staging, err := stageRun(*outdir, runID)
+	if err != nil {
+		return 1, err
+	}
+
+	switch *format {
+	case "csv":
+		// The tree has no sensible CSV shape, so only the flat application list is written.
+		slog.Info("-format csv skips metrics.json and metrics_flat.json")
+		bytes, err := WriteMetricsCSV(tree.FlattenForest(heads), filepath.Join(staging, "metrics_flat.csv"))
+		if err != nil {
+			return 1, err
+		}
+		slog.Info("wrote metrics", "file", "metrics_flat.csv", "bytes", bytes)
+
+	default:
+		enc := encoders[*format]
+		bytes, err := writeMetricsFile(enc, forest(heads), filepath.Join(staging, "metrics."+*format))
+		if err != nil {
+			return 1, err
+		}
+		slog.Info("wrote metrics", "file", "metrics."+*format, "bytes", bytes)
+
+		bytes, err = writeMetricsFile(enc, tree.FlattenForest(heads), filepath.Join(staging, "metrics_flat."+*format))
+		if err != nil {
+			return 1, err
+		}
+		slog.Info("wrote metrics", "file", "metrics_flat."+*format, "bytes", bytes)
+	}
+
+	if *renderFormat != "" {
+		if err := render(heads, *renderFormat, staging); err != nil {
+			return 1, err
+		}
+	}
+
+	if *staleDays > 0 {
+		report := staleReport{Now: started.Format(time.RFC3339), StaleDays: *staleDays, Organizations: []tree.StaleOrganization{}}
+		for _, head := range heads {
+			report.Organizations = append(report.Organizations, tree.StaleApplications(head, started, time.Duration(*staleDays)*24*time.Hour)...)
+		}
+		bytes, err := writeMetricsFile(jsonEncoder{}, report, filepath.Join(staging, "stale_apps.json"))
+		if err != nil {
+			return 1, err
+		}
+		slog.Info("wrote stale application report", "file", "stale_apps.json", "bytes", bytes)
+	}
+
+	if decisions != nil {
+		bytes, err := writeMetricsFile(jsonEncoder{}, decisions, filepath.Join(staging, "explain.json"))
+		if err != nil {
+			return 1, err
+		}
+		slog.Info("wrote decision log", "file", "explain.json", "bytes", bytes)
+	}
+
+	if err := commitRun(*outdir, staging, runID, *versioned); err != nil {
+		return 1, fmt.Errorf("committing run %s failed, staged artifacts kept in %s: %s", runID, staging, err)
+	}
+
+	if n := atomic.LoadUint64(&hedgedRequests); n > 0 {
+		slog.Info("hedged slow requests", "count", n)
+	}
+	if n := atomic.LoadUint64(&rejectedRequests); n > 0 {
+		return 1, fmt.Errorf("BUG: %d request(s) rejected by the read-only guard", n)
+	}
+	if failures := failureSummary(heads); failures != "" {
+		slog.Error(failures)
+	}
+	var unhealthy []tree.FlatApplication
+	if *strict {
+		unhealthy = unhealthyApplications(tree.FlattenForest(heads), healthy.values())
+	}
+	return exitStatus(warnings.summarize() || failed, unhealthy), nil
 }
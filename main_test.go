@@ -0,0 +1,1021 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Brodyzera/chgentree/tree"
+	"gopkg.in/yaml.v3"
+)
+
+// recordingServer answers every request with an empty JSON object or list and records the method
+// and path of each one that arrived.
+type recordingServer struct {
+	mux      sync.Mutex
+	received []string
+}
+
+func (s *recordingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	s.received = append(s.received, r.Method+" "+r.URL.Path)
+	s.mux.Unlock()
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/oauth2/token"):
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "t"})
+	case strings.HasPrefix(r.URL.Path, "/accounts/api/organizations/"):
+		id := strings.TrimPrefix(r.URL.Path, "/accounts/api/organizations/")
+		json.NewEncoder(w).Encode(tree.Organization{ID: id, Name: id, Environments: []*tree.Environment{{ID: "e1", Name: "Production"}}})
+	default:
+		w.Write([]byte("[]"))
+	}
+}
+
+// sentRequests returns the requests that reached the server.
+func (s *recordingServer) sentRequests() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return append([]string(nil), s.received...)
+}
+
+// readOnlyClient returns an *http.Client that sends through readOnlyTransport to srv.
+func readOnlyClient(srv *httptest.Server) *http.Client {
+	return &http.Client{Transport: &readOnlyTransport{next: srv.Client().Transport}}
+}
+
+// resetRejected zeroes rejectedRequests for a test and restores it afterwards.
+func resetRejected(t *testing.T) {
+	saved := atomic.SwapUint64(&rejectedRequests, 0)
+	t.Cleanup(func() { atomic.StoreUint64(&rejectedRequests, saved) })
+}
+
+func TestReadOnlyAllowsListedWrites(t *testing.T) {
+	resetRejected(t)
+	server := &recordingServer{}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	client := readOnlyClient(srv)
+
+	// One example path for each entry of allowedWrites, in the same order.
+	examples := []string{
+		"/accounts/api/v2/oauth2/token",
+	}
+	if len(examples) != len(allowedWrites) {
+		t.Fatalf("%d examples for %d allowed writes; add one for each new entry", len(examples), len(allowedWrites))
+	}
+	for i, w := range allowedWrites {
+		t.Run(w.Reason, func(t *testing.T) {
+			req, _ := http.NewRequest(w.Method, srv.URL+examples[i], strings.NewReader("{}"))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: %v", w.Method, examples[i], err)
+			}
+			resp.Body.Close()
+		})
+	}
+	if n := atomic.LoadUint64(&rejectedRequests); n != 0 {
+		t.Errorf("rejectedRequests = %d, want 0", n)
+	}
+}
+
+func TestReadOnlyRejectsOtherWrites(t *testing.T) {
+	resetRejected(t)
+	server := &recordingServer{}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	client := readOnlyClient(srv)
+
+	rejected := []struct {
+		method, path string
+	}{
+		{http.MethodPost, "/cloudhub/api/v2/applications"},
+		{http.MethodPut, "/accounts/api/organizations/o1"},
+		{http.MethodDelete, "/cloudhub/api/v2/applications/app1"},
+		{http.MethodPatch, "/accounts/api/v2/oauth2/token"},
+		{http.MethodPost, "/accounts/api/v2/oauth2/token/extra"},
+		{http.MethodPost, "/audit/v2/organizations/o1/query"},
+	}
+	for _, tt := range rejected {
+		req, _ := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader("{}"))
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+			t.Errorf("%s %s was let through", tt.method, tt.path)
+		}
+	}
+	if n := atomic.LoadUint64(&rejectedRequests); n != uint64(len(rejected)) {
+		t.Errorf("rejectedRequests = %d, want %d", n, len(rejected))
+	}
+	if sent := server.sentRequests(); len(sent) != 0 {
+		t.Errorf("server received %v, want nothing", sent)
+	}
+}
+
+// TestReadOnlyClientMethods drives every public method of tree.Client that makes requests through
+// the guard, so a write added to any of them fails here rather than in production.
+func TestReadOnlyClientMethods(t *testing.T) {
+	resetRejected(t)
+	server := &recordingServer{}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	httpClient := readOnlyClient(srv)
+	ctx := context.Background()
+
+	auth := &tree.ClientCredentials{TokenURL: srv.URL + "/" + tree.TokenPath, ClientID: "id", ClientSecret: "secret", HTTPClient: httpClient}
+	if err := auth.Login(ctx); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	c := tree.NewClient(httpClient, auth, 2)
+	c.BaseURL = srv.URL
+
+	root, err := c.InitTree(ctx, "root")
+	if err != nil {
+		t.Fatalf("InitTree: %v", err)
+	}
+	if err := c.GenerateApplications(ctx, root); err != nil {
+		t.Fatalf("GenerateApplications: %v", err)
+	}
+	if err := c.RetryFailures(ctx, root); err != nil {
+		t.Fatalf("RetryFailures: %v", err)
+	}
+	if _, err := c.InitForest(ctx, []string{"r1", "r2"}); err != nil {
+		t.Fatalf("InitForest: %v", err)
+	}
+
+	if n := atomic.LoadUint64(&rejectedRequests); n != 0 {
+		t.Errorf("rejectedRequests = %d, want 0", n)
+	}
+	for _, sent := range server.sentRequests() {
+		if !strings.HasPrefix(sent, "GET ") && (sent != "POST /"+tree.TokenPath) {
+			t.Errorf("server received %s", sent)
+		}
+	}
+}
+
+// spkiPin returns the pin of the certificate srv presents.
+func spkiPin(srv *httptest.Server) string {
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// pinnedGet GETs srv, trusting its certificate and requiring one of pins.
+func pinnedGet(srv *httptest.Server, pins []string) error {
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.VerifyConnection = verifyPins(pins)
+	resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// byteWriter writes one byte at a time, yielding between bytes, so Writes that aren't serialized
+// interleave mid-line, and are reported by the race detector.
+type byteWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *byteWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		w.buf.WriteByte(b)
+		runtime.Gosched()
+	}
+	return len(p), nil
+}
+
+func TestConsoleLinesDontInterleave(t *testing.T) {
+	const goroutines, lines = 20, 50
+	padding := strings.Repeat("x", 100)
+
+	slogPrinter := func(format string) func(w io.Writer) func(g, i int) {
+		return func(w io.Writer) func(g, i int) {
+			handler, err := newLogHandler(w, "info", format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			logger := slog.New(handler)
+			return func(g, i int) { logger.Info(padding, "goroutine", g, "line", i) }
+		}
+	}
+	for _, tt := range []struct {
+		name    string
+		printer func(w io.Writer) func(g, i int) // One printer shared by every goroutine
+		line    *regexp.Regexp
+	}{
+		{"output", func(w io.Writer) func(g, i int) {
+			saved := output.Writer()
+			output.SetOutput(w)
+			t.Cleanup(func() { output.SetOutput(saved) })
+			return func(g, i int) { output.Printf("goroutine=%d line=%d %s", g, i, padding) }
+		}, regexp.MustCompile(`^goroutine=(\d+) line=(\d+) x{100}$`)},
+		{"text log", slogPrinter("text"), regexp.MustCompile(`^time=\S+ level=INFO msg=x{100} goroutine=(\d+) line=(\d+)$`)},
+		{"json log", slogPrinter("json"), regexp.MustCompile(`^\{"time":"[^"]+","level":"INFO","msg":"x{100}","goroutine":(\d+),"line":(\d+)\}$`)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &byteWriter{}
+			print := tt.printer(w)
+			var wg sync.WaitGroup
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < lines; i++ {
+						print(g, i)
+					}
+				}(g)
+			}
+			wg.Wait()
+
+			seen := map[string]bool{}
+			for _, line := range strings.Split(strings.TrimSuffix(w.buf.String(), "\n"), "\n") {
+				m := tt.line.FindStringSubmatch(line)
+				if m == nil {
+					t.Fatalf("mangled line %q", line)
+				}
+				seen[m[1]+"/"+m[2]] = true
+			}
+			if len(seen) != goroutines*lines {
+				t.Errorf("%d distinct lines, want %d", len(seen), goroutines*lines)
+			}
+		})
+	}
+}
+
+func TestVerifyPins(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	pin := spkiPin(srv)
+	other := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	if err := pinnedGet(srv, []string{pin}); err != nil {
+		t.Errorf("matching pin: %v", err)
+	}
+	// During a rotation both the outgoing and the incoming key are pinned, and either may be presented.
+	if err := pinnedGet(srv, []string{other, pin}); err != nil {
+		t.Errorf("rotation with the new pin second: %v", err)
+	}
+	if err := pinnedGet(srv, []string{pin, other}); err != nil {
+		t.Errorf("rotation with the new pin first: %v", err)
+	}
+
+	err := pinnedGet(srv, []string{other})
+	if (err == nil) || !strings.Contains(err.Error(), "pin mismatch") || !strings.Contains(err.Error(), pin) {
+		t.Errorf("mismatched pin: %v, want a pin mismatch naming %s", err, pin)
+	}
+}
+
+func TestNewHTTPClientRejectsBadPins(t *testing.T) {
+	for _, pin := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := newHTTPClient(clientOptions{Pins: []string{pin}}); err == nil {
+			t.Errorf("pin %q was accepted", pin)
+		}
+	}
+}
+
+// failAfter replaces rename so that the call after the first n fails, restoring it when the test ends.
+func failAfter(t *testing.T, n int) {
+	calls := 0
+	rename = func(from, to string) error {
+		if calls++; calls > n {
+			return fmt.Errorf("injected failure renaming %s", from)
+		}
+		return os.Rename(from, to)
+	}
+	t.Cleanup(func() { rename = os.Rename })
+}
+
+// stage writes files into a new staging directory for runID, each holding the run ID.
+func stage(t *testing.T, outdir, runID string, files ...string) string {
+	t.Helper()
+	staging, err := stageRun(outdir, runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range files {
+		if err := ioutil.WriteFile(filepath.Join(staging, name), []byte(runID), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return staging
+}
+
+// checkConsistent fails t unless dir is what a consumer keying on COMPLETE may safely read: either
+// no marker at all, or a marker whose run wrote every artifact listed and no other artifact is there.
+// It returns the run ID of the marker, or "" if there's none.
+func checkConsistent(t *testing.T, dir string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(dir, completeMarker))
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	runID, listed := lines[0], map[string]bool{}
+	for _, name := range lines[1:] {
+		listed[name] = true
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("COMPLETE of %s lists %s: %v", runID, name, err)
+		} else if string(content) != runID {
+			t.Errorf("COMPLETE of %s lists %s, written by %s", runID, name, content)
+		}
+	}
+	for _, name := range runArtifacts() {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil && !listed[name] {
+			t.Errorf("%s is beside the COMPLETE of %s, which doesn't list it", name, runID)
+		}
+	}
+	return runID
+}
+
+func TestCommitRunReplacesEveryArtifact(t *testing.T) {
+	outdir := t.TempDir()
+	first := stage(t, outdir, "run1", "metrics.yaml", "metrics_flat.yaml", "stale_apps.json", "explain.json", renderFile)
+	if err := commitRun(outdir, first, "run1", false); err != nil {
+		t.Fatalf("committing run1: %v", err)
+	}
+	if got := checkConsistent(t, outdir); got != "run1" {
+		t.Fatalf("COMPLETE names %q, want run1", got)
+	}
+
+	second := stage(t, outdir, "run2", "metrics.json", "metrics_flat.json")
+	if err := commitRun(outdir, second, "run2", false); err != nil {
+		t.Fatalf("committing run2: %v", err)
+	}
+	if got := checkConsistent(t, outdir); got != "run2" {
+		t.Errorf("COMPLETE names %q, want run2", got)
+	}
+	if _, err := os.Stat(second); !os.IsNotExist(err) {
+		t.Errorf("staging directory left behind: %v", err)
+	}
+}
+
+func TestCommitRunFailures(t *testing.T) {
+	// run2 renames its two artifacts and then its marker.
+	for n := 0; n < 3; n++ {
+		t.Run(fmt.Sprintf("after %d renames", n), func(t *testing.T) {
+			outdir := t.TempDir()
+			first := stage(t, outdir, "run1", "metrics.yaml", "stale_apps.json", "explain.json")
+			if err := commitRun(outdir, first, "run1", false); err != nil {
+				t.Fatalf("committing run1: %v", err)
+			}
+
+			second := stage(t, outdir, "run2", "metrics.json", "metrics_flat.json")
+			failAfter(t, n)
+			if err := commitRun(outdir, second, "run2", false); err == nil {
+				t.Fatalf("commit succeeded despite the injected failure")
+			}
+			if got := checkConsistent(t, outdir); got != "" {
+				t.Errorf("COMPLETE of %s present after a failed commit", got)
+			}
+		})
+	}
+}
+
+func TestCommitRunVersionedFailures(t *testing.T) {
+	// run2 renames its marker, its directory and then current.
+	for n := 0; n < 3; n++ {
+		t.Run(fmt.Sprintf("after %d renames", n), func(t *testing.T) {
+			outdir := t.TempDir()
+			first := stage(t, outdir, "run1", "metrics.json", "explain.json")
+			if err := commitRun(outdir, first, "run1", true); err != nil {
+				t.Fatalf("committing run1: %v", err)
+			}
+
+			second := stage(t, outdir, "run2", "metrics.yaml")
+			failAfter(t, n)
+			if err := commitRun(outdir, second, "run2", true); err == nil {
+				t.Fatalf("commit succeeded despite the injected failure")
+			}
+			// current still leads to the whole of run1.
+			if got := checkConsistent(t, filepath.Join(outdir, "current")); got != "run1" {
+				t.Errorf("current is run %q, want run1", got)
+			}
+		})
+	}
+}
+
+func TestPruneStaging(t *testing.T) {
+	outdir := t.TempDir()
+	now := time.Now()
+	for i, runID := range []string{"run1", "run2", "run3", "unrelated"} {
+		dir := filepath.Join(outdir, ".staging-"+runID)
+		if runID == "unrelated" {
+			dir = filepath.Join(outdir, runID)
+		}
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "metrics.json"), make([]byte, 10000), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Oldest first, whatever the resolution of the file system's clock.
+		stamp := now.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(dir, stamp, stamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pruneStaging(outdir, 25000); err != nil {
+		t.Fatalf("pruneStaging: %v", err)
+	}
+	var left []string
+	entries, _ := ioutil.ReadDir(outdir)
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	if want := []string{".staging-run2", ".staging-run3", "unrelated"}; !reflect.DeepEqual(left, want) {
+		t.Errorf("left %v, want %v", left, want)
+	}
+}
+
+func TestCommitRunVersionedWithoutSymlinks(t *testing.T) {
+	symlink = func(oldname, newname string) error { return errors.New("symlinks not supported") }
+	t.Cleanup(func() { symlink = os.Symlink })
+
+	outdir := t.TempDir()
+	for _, runID := range []string{"run1", "run2"} {
+		staging := stage(t, outdir, runID, "metrics.json")
+		if err := commitRun(outdir, staging, runID, true); err != nil {
+			t.Fatalf("committing %s: %v", runID, err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(outdir, "current"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runID := strings.TrimSpace(string(b))
+	if runID != "run2" {
+		t.Fatalf("current holds %q, want run2", runID)
+	}
+	if got := checkConsistent(t, filepath.Join(outdir, runID)); got != "run2" {
+		t.Errorf("COMPLETE names %q, want run2", got)
+	}
+}
+
+// trackedBody is a response body that records being closed.
+type trackedBody struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (b *trackedBody) Close() error {
+	close(b.closed)
+	return nil
+}
+
+// stallingTransport stalls the first request until it's cancelled and answers every other one at
+// once.  Each response body is tracked by the attempt that sent it.
+type stallingTransport struct {
+	mux      sync.Mutex
+	attempts int
+	bodies   []*trackedBody
+	contexts []context.Context
+}
+
+func (s *stallingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.mux.Lock()
+	attempt := s.attempts
+	s.attempts++
+	body := &trackedBody{Reader: strings.NewReader(fmt.Sprintf("attempt %d", attempt)), closed: make(chan struct{})}
+	s.bodies = append(s.bodies, body)
+	s.contexts = append(s.contexts, req.Context())
+	s.mux.Unlock()
+
+	if attempt == 0 {
+		<-req.Context().Done()
+	}
+	// Even a cancelled attempt may manage to return a response, which must still be closed.
+	return &http.Response{StatusCode: http.StatusOK, Body: body, Request: req}, nil
+}
+
+// waitFor fails t if ch isn't closed within a second.
+func waitFor(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Errorf("%s didn't happen", what)
+	}
+}
+
+func TestHedgedTransportHedgeWins(t *testing.T) {
+	saved := atomic.SwapUint64(&hedgedRequests, 0)
+	t.Cleanup(func() { atomic.StoreUint64(&hedgedRequests, saved) })
+
+	next := &stallingTransport{}
+	transport := &hedgedTransport{next: next, after: 10 * time.Millisecond, budget: 1}
+	req, _ := http.NewRequest(http.MethodGet, "http://example.invalid/", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != "attempt 1" {
+		t.Errorf("body = %q, want the hedge's", b)
+	}
+
+	next.mux.Lock()
+	loser, loserCtx, winnerCtx := next.bodies[0], next.contexts[0], next.contexts[1]
+	next.mux.Unlock()
+	waitFor(t, loserCtx.Done(), "cancelling the stalled attempt")
+	waitFor(t, loser.closed, "closing the stalled attempt's body")
+
+	if winnerCtx.Err() != nil {
+		t.Errorf("winner cancelled before its body was read")
+	}
+	resp.Body.Close()
+	waitFor(t, winnerCtx.Done(), "releasing the winner's context on Close")
+
+	if n := atomic.LoadUint64(&hedgedRequests); n != 1 {
+		t.Errorf("hedgedRequests = %d, want 1", n)
+	}
+}
+
+func TestHedgedTransportBudget(t *testing.T) {
+	next := &stallingTransport{}
+	transport := &hedgedTransport{next: next, after: time.Millisecond, budget: 0}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.invalid/", nil)
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	next.mux.Lock()
+	defer next.mux.Unlock()
+	if next.attempts != 1 {
+		t.Errorf("%d attempts with no hedge budget, want 1", next.attempts)
+	}
+}
+
+// fixedPool is a slotPool with a fixed number of slots.
+type fixedPool struct {
+	free int64
+}
+
+func (p *fixedPool) TryAcquireSlot() bool {
+	if atomic.AddInt64(&p.free, -1) < 0 {
+		atomic.AddInt64(&p.free, 1)
+		return false
+	}
+	return true
+}
+
+func (p *fixedPool) ReleaseSlot() {
+	atomic.AddInt64(&p.free, 1)
+}
+
+func TestHedgedTransportTakesASlot(t *testing.T) {
+	pool := &fixedPool{free: 1}
+	next := &stallingTransport{}
+	transport := &hedgedTransport{next: next, after: 10 * time.Millisecond, budget: 2, slots: pool}
+	req, _ := http.NewRequest(http.MethodGet, "http://example.invalid/", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	if n := atomic.LoadInt64(&pool.free); n != 0 {
+		t.Errorf("%d slots free while the hedge's body is open, want 0", n)
+	}
+	resp.Body.Close()
+	if n := atomic.LoadInt64(&pool.free); n != 1 {
+		t.Errorf("%d slots free after the hedge's body is closed, want 1", n)
+	}
+}
+
+func TestHedgedTransportWithoutASlot(t *testing.T) {
+	pool := &fixedPool{free: 0}
+	next := &stallingTransport{}
+	transport := &hedgedTransport{next: next, after: time.Millisecond, budget: 1, slots: pool}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.invalid/", nil)
+	if resp, err := transport.RoundTrip(req); err == nil {
+		resp.Body.Close()
+	}
+	next.mux.Lock()
+	defer next.mux.Unlock()
+	if next.attempts != 1 {
+		t.Errorf("%d attempts with no slot free, want 1", next.attempts)
+	}
+	if n := atomic.LoadInt64(&transport.budget); n != 1 {
+		t.Errorf("budget = %d, want the unused hedge kept", n)
+	}
+}
+
+// yamlOf encodes v with yamlEncoder.
+func yamlOf(t *testing.T, v interface{}) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := (yamlEncoder{}).Encode(v, &buf); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	return buf.String()
+}
+
+func TestControlPlane(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		want    string
+		wantErr string // Part of the error, when there should be one
+	}{
+		{args: nil, want: tree.DefaultBaseURL},
+		{args: []string{"-region", "us"}, want: tree.DefaultBaseURL},
+		{args: []string{"-region", "eu"}, want: "https://eu1.anypoint.mulesoft.com"},
+		{args: []string{"-region", "gov"}, want: "https://gov.anypoint.mulesoft.com"},
+		{args: []string{"-region", "apac"}, wantErr: `unknown -region "apac"`},
+		{args: []string{"-region", "custom", "-baseurl", "https://anypoint.example.com"}, want: "https://anypoint.example.com"},
+		{args: []string{"-region", "custom", "-base-url", "https://anypoint.example.com/"}, want: "https://anypoint.example.com/"},
+		{args: []string{"-base-url", "https://anypoint.example.com"}, want: "https://anypoint.example.com"},
+		{args: []string{"-region", "custom"}, wantErr: "needs -baseurl"},
+		{args: []string{"-region", "eu", "-base-url", "https://anypoint.example.com"}, wantErr: "only be used with -region custom"},
+		{args: []string{"-baseurl", "http://anypoint.example.com"}, wantErr: "not an absolute https URL"},
+		{args: []string{"-baseurl", "anypoint.example.com"}, wantErr: "not an absolute https URL"},
+		{args: []string{"-baseurl", "https://anypoint.example.com/accounts"}, wantErr: "only the control plane host"},
+		{args: []string{"-baseurl", "https://anypoint.example.com?org=1"}, wantErr: "only the control plane host"},
+		{args: []string{"-baseurl", "https://anypoint.example.com/#top"}, wantErr: "only the control plane host"},
+		{args: []string{"-baseurl", "https://%zz"}, wantErr: "invalid URL escape"},
+	} {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			fs := flag.NewFlagSet("chgentree", flag.ContinueOnError)
+			region, baseURL := controlPlaneFlags(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+
+			got, err := resolveBaseURL(*region, *baseURL)
+			if err == nil {
+				err = checkBaseURL(got)
+			}
+			switch {
+			case tt.wantErr == "":
+				if (err != nil) || (got != tt.want) {
+					t.Errorf("got %q, %v, want %q", got, err, tt.want)
+				}
+			case (err == nil) || !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStrictExitStatus(t *testing.T) {
+	app := func(domain, status string) tree.FlatApplication {
+		return tree.FlatApplication{Application: tree.Application{Domain: domain, Status: status}}
+	}
+	healthy := []string{"started"} // Matched case-insensitively
+	for _, tt := range []struct {
+		name   string
+		apps   []tree.FlatApplication
+		failed bool
+		want   int
+	}{
+		{name: "all healthy", apps: []tree.FlatApplication{app("orders", "STARTED")}, want: 0},
+		{name: "unhealthy", apps: []tree.FlatApplication{app("orders", "STARTED"), app("billing", "UNDEPLOYED")}, want: exitUnhealthy},
+		{name: "failed and unhealthy", apps: []tree.FlatApplication{app("billing", "UNDEPLOYED")}, failed: true, want: 1},
+		{name: "failed", apps: []tree.FlatApplication{app("orders", "STARTED")}, failed: true, want: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitStatus(tt.failed, unhealthyApplications(tt.apps, healthy)); got != tt.want {
+				t.Errorf("exit status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectAuthenticator(t *testing.T) {
+	for _, tt := range []struct {
+		name                          string
+		token, clientID, clientSecret string
+		username, password            string // Flags
+		envUsername, envPassword      string
+		want                          string // The authenticator's type, or part of the error
+	}{
+		{name: "token", token: "t", want: "tree.StaticToken"},
+		{name: "connected app", clientID: "id", clientSecret: "secret", want: "*tree.ClientCredentials"},
+		{name: "username flags", username: "u", password: "p", want: "*tree.BasicAuth"},
+		{name: "username from the environment", envUsername: "u", envPassword: "p", want: "*tree.BasicAuth"},
+		{name: "token over the environment", token: "t", envUsername: "u", envPassword: "p", want: "tree.StaticToken"},
+		{name: "connected app over the environment", clientID: "id", clientSecret: "secret", envUsername: "u", envPassword: "p", want: "*tree.ClientCredentials"},
+		{name: "token over half the environment", token: "t", envUsername: "u", want: "tree.StaticToken"},
+		{name: "token and username flag", token: "t", username: "u", envPassword: "p", want: "more than one authentication method"},
+		{name: "token and connected app", token: "t", clientID: "id", clientSecret: "secret", want: "more than one authentication method"},
+		{name: "client ID alone", clientID: "id", want: "must be given together"},
+		{name: "username alone", envUsername: "u", want: "has no password"},
+		{name: "nothing", want: "no credentials given"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ANYPOINT_USERNAME", tt.envUsername)
+			t.Setenv("ANYPOINT_PASSWORD", tt.envPassword)
+			user := resolveCredential("username", tt.username, "ANYPOINT_USERNAME")
+			pass := resolveCredential("password", tt.password, "ANYPOINT_PASSWORD")
+
+			auth, err := selectAuthenticator(tt.token, tt.clientID, tt.clientSecret, user, pass, tree.NewClient(nil, nil, 1))
+			got := fmt.Sprintf("%T", auth)
+			if err != nil {
+				got = err.Error()
+			}
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	savedInterval, savedMemory, savedWarnings := heartbeatInterval, memoryInUse, warnings
+	t.Cleanup(func() { heartbeatInterval, memoryInUse, warnings = savedInterval, savedMemory, savedWarnings })
+	heartbeatInterval = time.Millisecond
+	warnings = &warningLog{}
+
+	// Memory use rises by 10 MiB a heartbeat against a 100 MiB budget, so it crosses 80% on the eighth.
+	var beats uint64
+	memoryInUse = func() uint64 { return atomic.AddUint64(&beats, 1) * 10 << 20 }
+
+	srv := httptest.NewServer(&recordingServer{})
+	defer srv.Close()
+	client := tree.NewClient(srv.Client(), tree.StaticToken("test"), 8)
+	client.BaseURL = srv.URL
+	liveness := filepath.Join(t.TempDir(), "alive")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchdog(ctx, client, liveness, 100<<20)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// (8-1)/2 of the 8 slots are reserved, leaving 5.
+	deadline := time.Now().Add(time.Second)
+	for free := -1; free != 5; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d slots free after a second, want 5", free)
+		}
+		time.Sleep(time.Millisecond)
+		for free = 0; client.TryAcquireSlot(); free++ {
+		}
+		for i := 0; i < free; i++ {
+			client.ReleaseSlot()
+		}
+	}
+	if n := atomic.LoadUint64(&beats); n < 8 {
+		t.Errorf("slots reserved after %d heartbeats, want 8 or more", n)
+	}
+
+	// The first heartbeat creates the liveness file, and later ones touch it after progress only.
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(liveness, old, old); err != nil {
+		t.Fatalf("liveness file: %v", err)
+	}
+	time.Sleep(10 * heartbeatInterval)
+	if info, _ := os.Stat(liveness); !info.ModTime().Equal(old) {
+		t.Errorf("liveness file touched without progress")
+	}
+	client.InitTree(ctx, "o1")
+	for info, _ := os.Stat(liveness); info.ModTime().Equal(old); info, _ = os.Stat(liveness) {
+		if time.Now().After(deadline.Add(time.Second)) {
+			t.Fatalf("liveness file not touched after progress")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	warnings.mux.Lock()
+	defer warnings.mux.Unlock()
+	if n := warnings.counts[warnMemoryPressure]; n != 1 {
+		t.Errorf("%d memory pressure warnings, want 1", n)
+	}
+}
+
+func TestYAMLScalars(t *testing.T) {
+	for _, tt := range []struct {
+		v    interface{}
+		want string
+	}{
+		{nil, "null\n"},
+		{"", "\"\"\n"},
+		{`Root "Co": <x> & y`, "'Root \"Co\": <x> & y'\n"},
+		{"line\nbreak\ttab", "|-\n  line\n  break\ttab\n"},
+		{"yes", "\"yes\"\n"},
+		{"Off", "\"Off\"\n"},
+		{"true", "\"true\"\n"},
+		{"12", "\"12\"\n"},
+		{12, "12\n"},
+		{-1.5, "-1.5\n"},
+		{1e21, "1.0e+21\n"},
+		{1e-7, "1.0e-7\n"},
+		{true, "true\n"},
+		{map[string]int{}, "{}\n"},
+		{[]string{}, "[]\n"},
+	} {
+		if got := yamlOf(t, tt.v); got != tt.want {
+			t.Errorf("%#v encoded as %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestYAMLBlocks(t *testing.T) {
+	type env struct {
+		Name string
+		Apps []string
+	}
+	type org struct {
+		Name         string
+		ID           string `json:"id"`
+		Environments []env
+		Tags         map[string]string
+		Children     []*org
+		Usage        *int `json:",omitempty"`
+	}
+	v := org{
+		Name:         `Root "Co": <x>`,
+		ID:           "1",
+		Environments: []env{{Name: "Production", Apps: []string{"a", "b"}}, {Name: "Sandbox", Apps: []string{}}},
+		Tags:         map[string]string{"on": "x", "two words": "y", "cost_center": "z"},
+		Children:     []*org{{Name: "Child", ID: "2"}},
+	}
+	want := `Name: 'Root "Co": <x>'
+id: "1"
+Environments:
+  - Name: Production
+    Apps:
+      - a
+      - b
+  - Name: Sandbox
+    Apps: []
+Tags:
+  cost_center: z
+  "on": x
+  two words: "y"
+Children:
+  - Name: Child
+    id: "2"
+    Environments: null
+    Tags: null
+    Children: null
+`
+	if got := yamlOf(t, v); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// Whatever the quoting, the YAML reads back as the same document as the JSON.
+	var fromYAML, fromJSON interface{}
+	if err := yaml.Unmarshal([]byte(want), &fromYAML); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(v)
+	json.Unmarshal(b, &fromJSON)
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Errorf("YAML reads back as %v, want %v", fromYAML, fromJSON)
+	}
+}
+
+func TestYAMLNestedLists(t *testing.T) {
+	got := yamlOf(t, [][]interface{}{{1, "a"}, {}, {map[string]int{"k": 1}}})
+	want := `- - 1
+  - a
+- []
+- - k: 1
+`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+// explainFixture serves an estate where the application orders is deployed four times and kept only
+// once: below MaxDepth, in a Sandbox the environment filter drops, stopped, and in an environment
+// that fails to load.  Organization c fails to load as well.
+func explainFixture(t *testing.T) *httptest.Server {
+	orgs := map[string]tree.Organization{
+		"root": {Name: "Root", ID: "root", SubOrganizationIds: []string{"a", "b", "c"},
+			Environments: []*tree.Environment{{ID: "root-prod", Name: "Production"}, {ID: "root-dev", Name: "Sandbox"}}},
+		"a": {Name: "A", ID: "a", SubOrganizationIds: []string{"a1"}, Environments: []*tree.Environment{{ID: "a-prod", Name: "Production"}}},
+		"b": {Name: "B", ID: "b", Environments: []*tree.Environment{{ID: "b-prod", Name: "Production"}}},
+	}
+	apps := map[string]string{
+		"root-prod": `[{"domain": "orders", "status": "STOPPED"}, {"domain": "billing", "status": "STOPPED"}]`,
+		"root-dev":  `[{"domain": "orders", "status": "STARTED"}]`,
+		"a-prod":    `[{"domain": "orders", "status": "STARTED"}]`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := strings.TrimPrefix(r.URL.Path, "/accounts/api/organizations/"); id != r.URL.Path {
+			if org, ok := orgs[id]; ok {
+				json.NewEncoder(w).Encode(org)
+				return
+			}
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if body, ok := apps[r.Header.Get("X-Anypnt-Env-Id")]; ok {
+			w.Write([]byte(body))
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// explainRun runs the pipeline against explainFixture the way run does, tracing target.
+func explainRun(t *testing.T, target string) []string {
+	srv := explainFixture(t)
+	c := tree.NewClient(srv.Client(), tree.StaticToken("test"), 2)
+	c.BaseURL = srv.URL
+	c.MaxDepth = 1
+	c.Warnf = func(tree.WarningCode, string, ...interface{}) {}
+	trail := &explainLog{target: target}
+	c.Explain = trail.record
+
+	ctx := context.Background()
+	root, err := c.InitTree(ctx, "root")
+	if root == nil {
+		t.Fatalf("InitTree: %v", err)
+	}
+	c.SkipEnvironments(root, tree.EnvironmentFilter{Names: []string{"Production"}})
+	c.GenerateApplications(ctx, root)
+	c.FilterApplicationsByStatus(root, []string{"STARTED"})
+	root.Normalize()
+
+	var trace []string
+	for _, d := range trail.finish([]*tree.Node{root}) {
+		trace = append(trace, strings.Join([]string{d.Stage, d.Outcome, d.OrgID, d.EnvironmentID, d.Domain}, " "))
+	}
+	return trace
+}
+
+func TestExplainApplication(t *testing.T) {
+	got := explainRun(t, "orders")
+	want := []string{
+		"build failed c  ",
+		"build not fetched a  ",
+		"environments excluded root root-dev ",
+		"fetch failed b b-prod ",
+		"status excluded root root-prod orders",
+		"status kept a a-prod orders",
+		"output kept a a-prod orders",
+	}
+	sort.Strings(got[:2]) // The tree build fetches a and c concurrently, so they're decided in either order.
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("trail\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestExplainOrganization(t *testing.T) {
+	got := explainRun(t, "a")
+	want := []string{
+		"build not fetched a  ",
+		"status kept a a-prod orders",
+		"output kept a  ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("trail\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	got = explainRun(t, "c")
+	want = []string{
+		"build failed c  ",
+		"output failed c  ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("trail\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestExplainNotFound(t *testing.T) {
+	got := explainRun(t, "missing")
+	if last := got[len(got)-1]; last != "output excluded   missing" {
+		t.Errorf("last decision %q, want the target reported missing from the output", last)
+	}
+}
@@ -0,0 +1,629 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBaseURL is the US control plane.
+const DefaultBaseURL = "https://anypoint.mulesoft.com"
+
+// Regions maps the name of each Anypoint control plane to its base URL.
+var Regions = map[string]string{
+	"us":  DefaultBaseURL,
+	"eu":  "https://eu1.anypoint.mulesoft.com",
+	"gov": "https://gov.anypoint.mulesoft.com",
+}
+
+// TokenPath is where Connected App credentials are exchanged for a bearer token.
+const TokenPath string = "accounts/api/v2/oauth2/token"
+
+// Defaults set by NewClient.
+const (
+	DefaultMaxRetries = 3
+	DefaultPageSize   = 100
+)
+
+// HTTPDoer sends HTTP requests.  *http.Client implements it; tests can supply a fake that returns
+// canned responses without a network.
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Client fetches organization trees and their applications from the Anypoint Platform.  Create it
+// with NewClient; the exported fields may be changed before the first request.
+type Client struct {
+	BaseURL       string        // The control plane, e.g. https://eu1.anypoint.mulesoft.com
+	Authenticator Authenticator // Adds the credentials to every request
+	HTTPClient    HTTPDoer      // Sends every request, so tests can inject a fake or point at a server
+	MaxRetries    int           // Retries after a request fails with HTTP 429 or a 5xx status
+	PageSize      int           // Applications requested per page
+	MaxDepth      int           // Levels of sub-organizations fetched below the root, or -1 for all
+	Warnf         WarnFunc      // Receives every warning the Client raises; nil logs them with slog
+	// Explain receives every Decision the pipeline makes, from concurrent goroutines.  While it's nil
+	// no decisions are recorded at all.
+	Explain func(Decision)
+
+	// sem holds a slot for every goroutine spawn has started, shared by the tree build and the
+	// application fetch, which bounds the number of goroutines.
+	sem chan struct{}
+	// requests holds a slot for every request in flight, however many goroutines are making them, so
+	// that there are never more than maxConcurrent at once.
+	requests chan struct{}
+
+	requestsCompleted uint64
+}
+
+// NewClient returns a Client against DefaultBaseURL that makes at most maxConcurrent requests at once.
+// A nil httpClient means http.DefaultClient.
+func NewClient(httpClient HTTPDoer, auth Authenticator, maxConcurrent int) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &Client{
+		BaseURL:       DefaultBaseURL,
+		Authenticator: auth,
+		HTTPClient:    httpClient,
+		MaxRetries:    DefaultMaxRetries,
+		PageSize:      DefaultPageSize,
+		MaxDepth:      -1,
+		// The goroutine walking the tree counts as one of the workers.
+		sem:      make(chan struct{}, maxConcurrent-1),
+		requests: make(chan struct{}, maxConcurrent),
+	}
+}
+
+// Endpoint joins path onto BaseURL.
+func (c *Client) Endpoint(path ...string) (string, error) {
+	return url.JoinPath(c.BaseURL, path...)
+}
+
+// Endpoints are the URLs of the API collections a Client reads.
+type Endpoints struct {
+	OrganizationsURL string // Each organization is fetched from its ID joined onto this
+	ApplicationsURL  string // Applications are listed here, one environment at a time
+}
+
+// Endpoints returns the URLs of the APIs under BaseURL.
+func (c *Client) Endpoints() (Endpoints, error) {
+	var e Endpoints
+	var err error
+	if e.OrganizationsURL, err = c.Endpoint("accounts/api/organizations"); err != nil {
+		return e, err
+	}
+	if e.ApplicationsURL, err = c.Endpoint("cloudhub/api/v2/applications"); err != nil {
+		return e, err
+	}
+	return e, nil
+}
+
+// RequestsCompleted counts the responses received so far, which tells progress from a hang.
+func (c *Client) RequestsCompleted() uint64 {
+	return atomic.LoadUint64(&c.requestsCompleted)
+}
+
+// Concurrency reports the maximum number of requests in flight at once.
+func (c *Client) Concurrency() int {
+	return cap(c.requests)
+}
+
+// ReserveSlots takes n concurrency slots out of use until ctx is done, blocking as needed for them
+// to come free.
+func (c *Client) ReserveSlots(ctx context.Context, n int) {
+	slots := c.requests
+	for i := 0; i < n; i++ {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// TryAcquireSlot takes a concurrency slot if one is free, for a request made outside the Client such
+// as a hedged duplicate, and reports whether it did.  The slot is held until ReleaseSlot.
+func (c *Client) TryAcquireSlot() bool {
+	select {
+	case c.requests <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReleaseSlot frees a slot taken by TryAcquireSlot.
+func (c *Client) ReleaseSlot() {
+	<-c.requests
+}
+
+// spawn runs f on a new goroutine when sem has a free slot, and on the calling goroutine otherwise.
+// Running inline when saturated keeps the goroutine count bounded and means no goroutine ever blocks
+// on a slot while holding one, so deep trees can't deadlock.
+func (c *Client) spawn(f func()) {
+	slots := c.sem
+	select {
+	case slots <- struct{}{}:
+		go func() {
+			defer func() { <-slots }()
+			f()
+		}()
+	default:
+		f()
+	}
+}
+
+// WarningCode is the stable category of a warning.  Codes are never reused or renumbered, and
+// callers may add their own beyond the ones raised here.
+type WarningCode string
+
+const (
+	WarnNonNumeric   WarningCode = "W001" // A numeric field held something else and decoded as 0, or lost a fraction
+	WarnDuplicateOrg WarningCode = "W002" // An organization was listed under more than one parent
+	WarnRetry        WarningCode = "W006" // A request failed transiently and is being retried
+	WarnRepeatedPage WarningCode = "W007" // A server ignored paging and sent the same page again
+)
+
+// WarnFunc receives a warning, with its message formatted as by fmt.Sprintf.
+type WarnFunc func(code WarningCode, format string, args ...interface{})
+
+// warn raises a warning with f, or logs it to the slog default logger if f is nil.
+func warn(f WarnFunc, code WarningCode, format string, args ...interface{}) {
+	if f == nil {
+		slog.Warn(fmt.Sprintf(format, args...), "code", code)
+		return
+	}
+	f(code, format, args...)
+}
+
+func (c *Client) warnf(code WarningCode, format string, args ...interface{}) {
+	warn(c.Warnf, code, format, args...)
+}
+
+// do sends req with the client's credentials.  If it comes back 401 and the authenticator can
+// renew its credentials, the request is sent once more.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if err := c.Authenticator.Authenticate(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := doWithRetry(c.HTTPClient, req, c.MaxRetries+1, retryBaseDelay, c.Warnf)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !c.Authenticator.Refresh(req) {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if err := c.Authenticator.Authenticate(retry); err != nil {
+		return nil, err
+	}
+	return doWithRetry(c.HTTPClient, retry, c.MaxRetries+1, retryBaseDelay, c.Warnf)
+}
+
+// errEmptyResponse is returned by decodeResponse when an object is expected but the body is empty.
+var errEmptyResponse = errors.New("empty response body")
+
+// Authenticator adds credentials to outgoing requests.
+type Authenticator interface {
+	// Authenticate sets the credentials on req.
+	Authenticate(req *http.Request) error
+	// Refresh is called when req came back 401.  It reports whether new credentials are available,
+	// in which case the request is worth sending again.
+	Refresh(req *http.Request) bool
+}
+
+// BasicAuth authenticates with an Anypoint username and password.
+type BasicAuth struct {
+	Username, Password string
+}
+
+func (a *BasicAuth) Authenticate(req *http.Request) error {
+	req.SetBasicAuth(a.Username, a.Password)
+	return nil
+}
+
+func (a *BasicAuth) Refresh(req *http.Request) bool {
+	return false
+}
+
+// StaticToken authenticates with a bearer token obtained elsewhere, which it can't renew.
+type StaticToken string
+
+func (t StaticToken) Authenticate(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+string(t))
+	return nil
+}
+
+func (t StaticToken) Refresh(req *http.Request) bool {
+	return false
+}
+
+// ClientCredentials authenticates as a Connected App via the OAuth 2.0 client credentials grant.  The
+// bearer token is cached and only exchanged again after a request is rejected with it.  The token is
+// fetched from TokenURL, usually Client.Endpoint(TokenPath), with HTTPClient.
+type ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	HTTPClient   HTTPDoer
+	Warnf        WarnFunc // Receives the warnings raised by the exchange; nil logs them with slog
+
+	mux   sync.Mutex // For locking token
+	token string
+}
+
+func (a *ClientCredentials) Authenticate(req *http.Request) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.token == "" {
+		if err := a.exchange(req.Context()); err != nil {
+			return err
+		}
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+// Login exchanges the client credentials for a token ahead of the first request.
+func (a *ClientCredentials) Login(ctx context.Context) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	return a.exchange(ctx)
+}
+
+func (a *ClientCredentials) Refresh(req *http.Request) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	// Several requests may fail with the same expired token; only the first needs to drop it.
+	if req.Header.Get("Authorization") == "Bearer "+a.token {
+		a.token = ""
+	}
+	return true
+}
+
+// exchange fetches a new token.  The caller must hold mux.
+func (a *ClientCredentials) exchange(ctx context.Context) error {
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {a.ClientID},
+		"client_secret": {a.ClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", a.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := a.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := doWithRetry(client, req, DefaultMaxRetries+1, retryBaseDelay, a.Warnf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("token exchange failed: HTTP status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("token exchange failed: %s", err)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := decodeResponse(body, &token); err != nil {
+		return fmt.Errorf("token exchange failed: %s", err)
+	}
+	if token.AccessToken == "" {
+		return errors.New("token exchange failed: no access_token in response")
+	}
+	a.token = token.AccessToken
+	return nil
+}
+
+// decodeResponse unmarshals a response body into v.  A 204 or an empty (or whitespace-only) body
+// decodes to an empty slice when v points to a slice, and to errEmptyResponse otherwise.
+func decodeResponse(body []byte, v interface{}) error {
+	if len(bytes.TrimSpace(body)) == 0 {
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.Ptr && rv.Elem().Kind() == reflect.Slice {
+			rv.Elem().Set(reflect.MakeSlice(rv.Elem().Type(), 0, 0))
+			return nil
+		}
+		return errEmptyResponse
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("decoding response: %w, body %s", err, snippet(body))
+	}
+	return nil
+}
+
+// snippetLength is how much of an undecodable body is quoted in its error.
+const snippetLength = 120
+
+// snippet quotes the start of body for an error message.
+func snippet(body []byte) string {
+	body = bytes.TrimSpace(body)
+	if len(body) > snippetLength {
+		return fmt.Sprintf("%q...", body[:snippetLength])
+	}
+	return fmt.Sprintf("%q", body)
+}
+
+// retryBaseDelay is the wait before the first retry, doubling with each attempt after it.
+const retryBaseDelay = time.Second
+
+// retryableStatus reports whether a response with the given status is worth retrying.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// maxRetryDelay caps the wait before a retry, however long the server asks for.
+const maxRetryDelay = time.Minute
+
+// retryDelay returns how long to wait before the given retry attempt, honoring a Retry-After header
+// in either its seconds or HTTP-date form and otherwise backing off exponentially from baseDelay
+// with jitter.  It's never more than maxRetryDelay.
+func retryDelay(attempt int, retryAfter string, baseDelay time.Duration) time.Duration {
+	var d time.Duration
+	if secs, err := strconv.ParseInt(retryAfter, 10, 64); err == nil && secs >= 0 {
+		if secs > int64(maxRetryDelay/time.Second) {
+			return maxRetryDelay
+		}
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(retryAfter); err == nil {
+		d = time.Until(t)
+		if d < 0 {
+			return 0
+		}
+	} else {
+		d = baseDelay << uint(attempt)
+		if (d <= 0) || (d > maxRetryDelay) {
+			// Past the cap, or overflowed by a large attempt number.
+			return maxRetryDelay
+		}
+		d += time.Duration(rand.Int63n(int64(d)/2 + 1))
+	}
+
+	if d > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return d
+}
+
+// doWithRetry sends req with client, retrying HTTP 429 and 5xx responses for up to maxAttempts
+// attempts in all, and raising a warning with warnf before each retry.  A request with a body is only
+// retried if GetBody can replay it.  Any other response is returned to the caller; running out of
+// attempts returns the last status as an error.
+func doWithRetry(client HTTPDoer, req *http.Request, maxAttempts int, baseDelay time.Duration, warnf WarnFunc) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		try := req
+		if attempt > 0 {
+			try = req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				try.Body = body
+			}
+		}
+
+		resp, err := client.Do(try)
+		if err != nil {
+			slog.Debug("HTTP request failed", "method", try.Method, "url", try.URL, "attempt", attempt+1, "err", err)
+			return nil, err
+		}
+		slog.Debug("HTTP request", "method", try.Method, "url", try.URL, "status", resp.StatusCode, "attempt", attempt+1)
+		if !retryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		replayable := (req.Body == nil) || (req.Body == http.NoBody) || (req.GetBody != nil)
+		if (attempt+1 >= maxAttempts) || !replayable {
+			return nil, fmt.Errorf("HTTP status %d after %d attempts", resp.StatusCode, attempt+1)
+		}
+
+		delay := retryDelay(attempt, resp.Header.Get("Retry-After"), baseDelay)
+		warn(warnf, WarnRetry, "HTTP status %d from %s, retrying in %s", resp.StatusCode, req.URL, delay)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// fetch GETs requestURL and returns the response body and headers, holding one of the request
+// slots until the body is read.  Transient failures are retried by doWithRetry; any other non-OK
+// status is returned as an error.
+func (c *Client) fetch(ctx context.Context, requestURL string, header http.Header) ([]byte, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	select {
+	case c.requests <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		<-c.requests
+		return nil, nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	<-c.requests
+	if err != nil {
+		return nil, nil, err
+	}
+	atomic.AddUint64(&c.requestsCompleted, 1)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return nil, nil, fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return body, resp.Header, nil
+}
+
+// getOrganizationMetrics fetches and decodes an organization.  A body that doesn't decode to an
+// organization with an ID, such as an error page, is an error rather than an empty organization.
+func (c *Client) getOrganizationMetrics(ctx context.Context, orgID string) (Organization, error) {
+	var organization Organization
+	endpoints, err := c.Endpoints()
+	if err != nil {
+		return organization, err
+	}
+	requestURL, err := url.JoinPath(endpoints.OrganizationsURL, orgID)
+	if err != nil {
+		return organization, err
+	}
+
+	body, _, err := c.fetch(ctx, requestURL, nil)
+	if err != nil {
+		return organization, fmt.Errorf("organization %s: %w", orgID, err)
+	}
+	if err := decodeResponse(body, &organization); err != nil {
+		return organization, fmt.Errorf("organization %s: %w", orgID, err)
+	}
+	if organization.ID == "" {
+		return organization, fmt.Errorf("organization %s: no organization in response, body %s", orgID, snippet(body))
+	}
+	slog.Debug("fetched organization", "org", orgID, "name", organization.Name,
+		"sub_organizations", len(organization.SubOrganizationIds), "environments", len(organization.Environments))
+	return organization, nil
+}
+
+// getDeployedArtifacts fetches every application in the environment, PageSize at a time, until it
+// has as many as the X-Total-Count header gives or, without one, a short page marks the end.  A
+// failed page fails the whole environment rather than leaving a list that looks complete.
+func (c *Client) getDeployedArtifacts(ctx context.Context, environment string) ([]*Application, error) {
+	endpoints, err := c.Endpoints()
+	if err != nil {
+		return nil, err
+	}
+	applicationsURL := endpoints.ApplicationsURL
+
+	applications := []*Application{}
+	for offset := 0; ; offset += c.PageSize {
+		query := url.Values{"offset": {strconv.Itoa(offset)}, "limit": {strconv.Itoa(c.PageSize)}}
+		body, header, err := c.fetch(ctx, applicationsURL+"?"+query.Encode(), http.Header{"X-Anypnt-Env-Id": {environment}})
+		if err != nil {
+			return nil, fmt.Errorf("environment %s: page at offset %d: %w", environment, offset, err)
+		}
+		var page []*Application
+		if err := decodeResponse(body, &page); err != nil {
+			return nil, fmt.Errorf("environment %s: page at offset %d: %w", environment, offset, err)
+		}
+		// A server that ignores offset would otherwise repeat the first page forever.
+		if (offset > 0) && samePage(page, applications[offset-c.PageSize:]) {
+			c.warnf(WarnRepeatedPage, "environment %s: page at offset %d repeats the previous page, taking the %d applications before it as the whole list",
+				environment, offset, len(applications))
+			return applications, nil
+		}
+		c.checkNumeric(environment, body, page)
+		for _, app := range page {
+			app.setLastUpdated()
+		}
+		applications = append(applications, page...)
+
+		total, err := strconv.Atoi(header.Get("X-Total-Count"))
+		if (err == nil && len(applications) >= total) || (len(page) != c.PageSize) {
+			slog.Debug("fetched applications", "environment", environment, "count", len(applications), "pages", offset/c.PageSize+1)
+			return applications, nil
+		}
+	}
+}
+
+// numericFields are the FlexibleInt fields of an application, left undecoded.
+type numericFields struct {
+	Domain  string
+	Workers struct {
+		Amount json.RawMessage
+	} `json:"workers"`
+	LastUpdateTime json.RawMessage
+}
+
+// checkNumeric raises WarnNonNumeric for every numeric field of the applications in body that
+// decoded as 0 because it held something else, marking a worker amount like that as unknown in page,
+// and for every one that had a fraction truncated.
+func (c *Client) checkNumeric(environment string, body []byte, page []*Application) {
+	var apps []numericFields
+	if (json.Unmarshal(body, &apps) != nil) || (len(apps) != len(page)) {
+		return
+	}
+	for i, app := range apps {
+		for _, field := range []struct {
+			name    string
+			raw     json.RawMessage
+			unknown *bool
+		}{{"workers.amount", app.Workers.Amount, &page[i].Workers.AmountUnknown}, {"lastUpdateTime", app.LastUpdateTime, nil}} {
+			if field.raw == nil {
+				continue
+			}
+			v, truncated, ok := parseFlexibleInt(field.raw)
+			switch {
+			case !ok:
+				if field.unknown != nil {
+					*field.unknown = true
+				}
+				c.warnf(WarnNonNumeric, "environment %s: application %s has non-numeric %s %s, decoded as 0 (unknown)",
+					environment, app.Domain, field.name, field.raw)
+			case truncated:
+				c.warnf(WarnNonNumeric, "environment %s: application %s has fractional %s %s, truncated to %d",
+					environment, app.Domain, field.name, field.raw, v)
+			}
+		}
+	}
+}
+
+// samePage reports whether page lists the same applications as previous, in the same order.
+func samePage(page, previous []*Application) bool {
+	if len(page) != len(previous) {
+		return false
+	}
+	for i := range page {
+		if page[i].Domain != previous[i].Domain {
+			return false
+		}
+	}
+	return true
+}
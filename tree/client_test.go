@@ -0,0 +1,376 @@
+package tree
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// emptyBodies are the responses some endpoints send in place of an empty list.
+var emptyBodies = []struct {
+	name   string
+	status int
+	body   string
+}{
+	{"204", http.StatusNoContent, ""},
+	{"empty 200", http.StatusOK, ""},
+	{"whitespace 200", http.StatusOK, " \r\n\t"},
+}
+
+// respond is a handler that answers every request with status and body.
+func respond(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+func TestDecodeResponseEmpty(t *testing.T) {
+	for _, tt := range emptyBodies {
+		t.Run(tt.name, func(t *testing.T) {
+			var apps []*Application
+			if err := decodeResponse([]byte(tt.body), &apps); err != nil {
+				t.Fatalf("decoding into a slice: %v", err)
+			}
+			if (apps == nil) || (len(apps) != 0) {
+				t.Errorf("slice = %#v, want empty and non-nil", apps)
+			}
+
+			var organization Organization
+			if err := decodeResponse([]byte(tt.body), &organization); !errors.Is(err, errEmptyResponse) {
+				t.Errorf("decoding into a struct: %v, want errEmptyResponse", err)
+			}
+		})
+	}
+}
+
+func TestDecodeResponseGarbage(t *testing.T) {
+	var organization Organization
+	err := decodeResponse([]byte("<html>Bad gateway</html>"), &organization)
+	if (err == nil) || !strings.Contains(err.Error(), "<html>Bad gateway</html>") {
+		t.Errorf("error = %v, want one quoting the body", err)
+	}
+}
+
+func TestEmptyResponsesFromEveryFetcher(t *testing.T) {
+	for _, tt := range emptyBodies {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, respond(tt.status, tt.body), 1)
+
+			apps, err := c.getDeployedArtifacts(context.Background(), "e1")
+			if err != nil {
+				t.Errorf("getDeployedArtifacts: %v", err)
+			} else if (apps == nil) || (len(apps) != 0) {
+				t.Errorf("getDeployedArtifacts = %#v, want an empty list", apps)
+			}
+
+			if _, err := c.getOrganizationMetrics(context.Background(), "o1"); !errors.Is(err, errEmptyResponse) {
+				t.Errorf("getOrganizationMetrics: %v, want errEmptyResponse", err)
+			}
+
+			auth := &ClientCredentials{TokenURL: c.BaseURL + "/" + TokenPath, ClientID: "id", ClientSecret: "secret", HTTPClient: c.HTTPClient}
+			if err := auth.Login(context.Background()); (err == nil) || !strings.Contains(err.Error(), errEmptyResponse.Error()) {
+				t.Errorf("token exchange: %v, want an empty response error", err)
+			}
+		})
+	}
+}
+
+func TestTokenExchange(t *testing.T) {
+	c := newTestClient(t, respond(http.StatusOK, `{"access_token": "abc"}`), 1)
+	auth := &ClientCredentials{TokenURL: c.BaseURL + "/" + TokenPath, HTTPClient: c.HTTPClient}
+	if err := auth.Login(context.Background()); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", c.BaseURL, nil)
+	if err := auth.Authenticate(req); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer abc" {
+		t.Errorf("Authorization = %q, want Bearer abc", got)
+	}
+}
+
+// cannedDoer is an HTTPDoer that answers each request with the next of its responses, in order,
+// recording what it was sent.
+type cannedDoer struct {
+	responses []cannedResponse
+	sent      []string // The method, path, and Authorization header of each request
+}
+
+type cannedResponse struct {
+	status int
+	body   string
+}
+
+func (d *cannedDoer) Do(req *http.Request) (*http.Response, error) {
+	d.sent = append(d.sent, strings.Join([]string{req.Method, req.URL.Path, req.Header.Get("Authorization")}, " "))
+	if len(d.responses) == 0 {
+		return nil, errors.New("no more canned responses")
+	}
+	r := d.responses[0]
+	d.responses = d.responses[1:]
+	return &http.Response{
+		StatusCode: r.status,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(r.body)),
+		Request:    req,
+	}, nil
+}
+
+func TestRefreshOnUnauthorized(t *testing.T) {
+	token := func(s string) cannedResponse { return cannedResponse{http.StatusOK, `{"access_token": "` + s + `"}`} }
+	org := cannedResponse{http.StatusOK, `{"id": "o1", "name": "Org"}`}
+	unauthorized := cannedResponse{http.StatusUnauthorized, ""}
+
+	for _, tt := range []struct {
+		name        string
+		credentials bool // Client credentials, which can be refreshed, in place of a static token
+		responses   []cannedResponse
+		want        []string
+		wantErr     bool
+	}{
+		{
+			name:        "refreshed",
+			credentials: true,
+			responses:   []cannedResponse{token("t1"), unauthorized, token("t2"), org},
+			want: []string{
+				"POST /accounts/api/v2/oauth2/token ",
+				"GET /accounts/api/organizations/o1 Bearer t1",
+				"POST /accounts/api/v2/oauth2/token ",
+				"GET /accounts/api/organizations/o1 Bearer t2",
+			},
+		},
+		{
+			name:        "rejected again",
+			credentials: true,
+			responses:   []cannedResponse{token("t1"), unauthorized, token("t2"), unauthorized},
+			want: []string{
+				"POST /accounts/api/v2/oauth2/token ",
+				"GET /accounts/api/organizations/o1 Bearer t1",
+				"POST /accounts/api/v2/oauth2/token ",
+				"GET /accounts/api/organizations/o1 Bearer t2",
+			},
+			wantErr: true,
+		},
+		{
+			name:      "static token",
+			responses: []cannedResponse{unauthorized},
+			want:      []string{"GET /accounts/api/organizations/o1 Bearer static"},
+			wantErr:   true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			doer := &cannedDoer{responses: tt.responses}
+			c := NewClient(doer, StaticToken("static"), 1)
+			c.BaseURL = "https://anypoint.test"
+			if tt.credentials {
+				tokenURL, _ := c.Endpoint(TokenPath)
+				c.Authenticator = &ClientCredentials{TokenURL: tokenURL, ClientID: "id", ClientSecret: "secret", HTTPClient: doer}
+			}
+
+			organization, err := c.getOrganizationMetrics(context.Background(), "o1")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("getOrganizationMetrics = %+v, want an error", organization)
+				}
+			} else if (err != nil) || (organization.ID != "o1") {
+				t.Errorf("getOrganizationMetrics = %+v, %v, want org o1", organization, err)
+			}
+			if !reflect.DeepEqual(doer.sent, tt.want) {
+				t.Errorf("sent\n%s\nwant\n%s", strings.Join(doer.sent, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+// inFlightCounter wraps a handler, tracking the most requests it has ever had in flight at once.
+type inFlightCounter struct {
+	next          http.Handler
+	inFlight, max int64
+}
+
+func (h *inFlightCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt64(&h.inFlight, 1)
+	defer atomic.AddInt64(&h.inFlight, -1)
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if (n <= max) || atomic.CompareAndSwapInt64(&h.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	h.next.ServeHTTP(w, r)
+}
+
+func TestConcurrencyBound(t *testing.T) {
+	platform := &fakePlatform{orgs: map[string]Organization{}, apps: map[string][]Application{}, fail: map[string]int{}}
+	var roots []string
+	for i := 0; i < 6; i++ {
+		root := fmt.Sprintf("r%d", i)
+		roots = append(roots, root)
+		org := Organization{Name: root, ID: root}
+		for j := 0; j < 3; j++ {
+			id := fmt.Sprintf("%s-%d", root, j)
+			org.SubOrganizationIds = append(org.SubOrganizationIds, id)
+			platform.orgs[id] = Organization{Name: id, ID: id, Environments: []*Environment{{ID: id + "-e", Name: "Production"}}}
+			platform.apps[id+"-e"] = []Application{{Domain: id + "-app"}}
+		}
+		platform.orgs[root] = org
+	}
+	counter := &inFlightCounter{next: platform}
+
+	for _, maxConcurrent := range []int{1, 2, 4} {
+		atomic.StoreInt64(&counter.max, 0)
+		c := newTestClient(t, counter, maxConcurrent)
+		heads, err := c.InitForest(context.Background(), roots)
+		if err != nil {
+			t.Fatalf("InitForest: %v", err)
+		}
+		for _, head := range heads {
+			if err := c.GenerateApplications(context.Background(), head); err != nil {
+				t.Fatalf("GenerateApplications: %v", err)
+			}
+		}
+		if got := atomic.LoadInt64(&counter.max); got > int64(maxConcurrent) {
+			t.Errorf("max concurrency %d: %d requests were in flight at once", maxConcurrent, got)
+		}
+		if got := len(heads); got != len(roots) {
+			t.Errorf("max concurrency %d: %d trees, want %d", maxConcurrent, got, len(roots))
+		}
+	}
+}
+
+func TestSlots(t *testing.T) {
+	c := NewClient(nil, StaticToken("test"), 2)
+	if !c.TryAcquireSlot() || !c.TryAcquireSlot() {
+		t.Fatalf("couldn't take both slots")
+	}
+	if c.TryAcquireSlot() {
+		t.Errorf("took a third slot of two")
+	}
+	c.ReleaseSlot()
+	if !c.TryAcquireSlot() {
+		t.Errorf("couldn't take a released slot")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		attempt    int
+		retryAfter string
+		min, max   time.Duration
+	}{
+		{"seconds", 0, "3", 3 * time.Second, 3 * time.Second},
+		{"zero seconds", 2, "0", 0, 0},
+		{"an hour of seconds", 0, "3600", maxRetryDelay, maxRetryDelay},
+		{"overflowing seconds", 0, "99999999999999", maxRetryDelay, maxRetryDelay},
+		{"date in the past", 0, "Mon, 02 Jan 2006 15:04:05 GMT", 0, 0},
+		{"date in an hour", 0, time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), maxRetryDelay, maxRetryDelay},
+		{"first backoff", 0, "", time.Second, 1500 * time.Millisecond},
+		{"third backoff", 2, "", 4 * time.Second, 6 * time.Second},
+		{"long backoff", 10, "", maxRetryDelay, maxRetryDelay},
+		{"overflowing backoff", 70, "", maxRetryDelay, maxRetryDelay},
+		{"garbage", 1, "soon", 2 * time.Second, 3 * time.Second},
+	} {
+		if d := retryDelay(tt.attempt, tt.retryAfter, time.Second); (d < tt.min) || (d > tt.max) {
+			t.Errorf("%s: delay %s, want between %s and %s", tt.name, d, tt.min, tt.max)
+		}
+	}
+}
+
+// appsServer serves n applications for every environment, honoring offset and limit unless
+// ignorePaging is set, and counts the requests it got.
+type appsServer struct {
+	n            int
+	ignorePaging bool
+	totalCount   bool // Send X-Total-Count
+	requests     int64
+}
+
+func (s *appsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&s.requests, 1)
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if s.ignorePaging {
+		offset, limit = 0, s.n
+	}
+
+	page := []Application{}
+	for i := offset; (i < s.n) && (i < offset+limit); i++ {
+		page = append(page, Application{Domain: fmt.Sprintf("app%03d", i)})
+	}
+	if s.totalCount {
+		w.Header().Set("X-Total-Count", strconv.Itoa(s.n))
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func TestRepeatedPageWarnsOnce(t *testing.T) {
+	// Paging is ignored, so the second request gets the non-numeric amount again.
+	c := newTestClient(t, respond(http.StatusOK, `[{"domain": "app1", "workers": {"amount": "two"}}]`), 1)
+	warnings := captureWarnings(c)
+	c.PageSize = 1
+
+	apps, err := c.getDeployedArtifacts(context.Background(), "e1")
+	if (err != nil) || (len(apps) != 1) {
+		t.Fatalf("getDeployedArtifacts = %d applications, %v, want 1", len(apps), err)
+	}
+	if want := []WarningCode{WarnNonNumeric, WarnRepeatedPage}; !reflect.DeepEqual(*warnings, want) {
+		t.Errorf("warnings = %v, want %v", *warnings, want)
+	}
+}
+
+func TestPaging(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		server   appsServer
+		pageSize int
+		requests int64
+		warnings []WarningCode
+	}{
+		{"short last page", appsServer{n: 5}, 2, 3, nil},
+		{"full last page", appsServer{n: 4}, 2, 3, nil},
+		{"full last page with a total", appsServer{n: 4, totalCount: true}, 2, 2, nil},
+		{"paging ignored", appsServer{n: 100, ignorePaging: true}, 100, 2, []WarningCode{WarnRepeatedPage}},
+		{"paging ignored with a total", appsServer{n: 100, ignorePaging: true, totalCount: true}, 100, 1, nil},
+		{"paging ignored, short", appsServer{n: 3, ignorePaging: true}, 100, 1, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, &tt.server, 1)
+			warnings := captureWarnings(c)
+			c.PageSize = tt.pageSize
+
+			apps, err := c.getDeployedArtifacts(context.Background(), "e1")
+			if err != nil {
+				t.Fatalf("getDeployedArtifacts: %v", err)
+			}
+			if len(apps) != tt.server.n {
+				t.Errorf("%d applications, want %d", len(apps), tt.server.n)
+			}
+			for i, app := range apps {
+				if want := fmt.Sprintf("app%03d", i); app.Domain != want {
+					t.Errorf("application %d is %s, want %s", i, app.Domain, want)
+					break
+				}
+			}
+			if n := atomic.LoadInt64(&tt.server.requests); n != tt.requests {
+				t.Errorf("%d requests, want %d", n, tt.requests)
+			}
+			if !reflect.DeepEqual(*warnings, tt.warnings) && (len(*warnings)+len(tt.warnings) > 0) {
+				t.Errorf("warnings = %v, want %v", *warnings, tt.warnings)
+			}
+		})
+	}
+}
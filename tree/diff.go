@@ -0,0 +1,376 @@
+package tree
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Diff is what changed between two snapshots of the organization trees.  Organizations are matched
+// by ID, environments by organization and environment ID, and applications by those and their
+// domain.
+type Diff struct {
+	AddedOrganizations      []OrganizationRef
+	RemovedOrganizations    []OrganizationRef
+	UncomparedOrganizations []OrganizationRef // Organizations that failed or weren't fetched in either snapshot
+	AddedEnvironments       []EnvironmentRef
+	RemovedEnvironments     []EnvironmentRef
+	Uncompared              []EnvironmentRef // Environments that failed or were skipped in either snapshot
+	Added                   []FlatApplication
+	Removed                 []FlatApplication
+	Changed                 []ApplicationChange
+}
+
+// OrganizationRef identifies an organization in a Diff.
+type OrganizationRef struct {
+	OrgID   string
+	OrgName string
+	Reason  string `json:",omitempty"` // Why the organization wasn't compared
+}
+
+// EnvironmentRef identifies an environment in a Diff.
+type EnvironmentRef struct {
+	OrgID           string
+	OrgName         string
+	EnvironmentID   string
+	EnvironmentName string
+	Reason          string `json:",omitempty"` // Why the environment's applications weren't compared
+}
+
+// ApplicationChange is an application found in both snapshots, as it is in the new one, with every
+// field that differs.
+type ApplicationChange struct {
+	FlatApplication
+	Changes []FieldChange
+}
+
+// FieldChange is one field of an application that differs between the snapshots.
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// Empty reports whether the snapshots were the same.  Uncompared organizations and environments
+// don't count as differences.
+func (d *Diff) Empty() bool {
+	return (len(d.AddedOrganizations) == 0) && (len(d.RemovedOrganizations) == 0) &&
+		(len(d.AddedEnvironments) == 0) && (len(d.RemovedEnvironments) == 0) &&
+		(len(d.Added) == 0) && (len(d.Removed) == 0) && (len(d.Changed) == 0)
+}
+
+// snapshot indexes one side of a diff, with the keys of each map in sorted order.
+type snapshot struct {
+	orgs                     map[string]*Node
+	envs                     map[string]envEntry
+	apps                     map[string]FlatApplication
+	orgIDs, envKeys, appKeys []string
+}
+
+type envEntry struct {
+	org         *Node
+	environment *Environment
+}
+
+func indexSnapshot(roots []*Node) snapshot {
+	s := snapshot{orgs: map[string]*Node{}, envs: map[string]envEntry{}, apps: map[string]FlatApplication{}}
+	var walk func(p *Node)
+	walk = func(p *Node) {
+		s.orgs[p.BusinessOrganization.ID] = p
+		for _, environment := range p.BusinessOrganization.Environments {
+			s.envs[p.BusinessOrganization.ID+"/"+environment.ID] = envEntry{org: p, environment: environment}
+		}
+		for _, c := range p.Children {
+			walk(c)
+		}
+	}
+	for _, root := range roots {
+		walk(root)
+	}
+	for _, app := range FlattenForest(roots) {
+		s.apps[app.OrgID+"/"+app.EnvironmentID+"/"+app.Domain] = app
+	}
+
+	for id := range s.orgs {
+		s.orgIDs = append(s.orgIDs, id)
+	}
+	for key := range s.envs {
+		s.envKeys = append(s.envKeys, key)
+	}
+	for key := range s.apps {
+		s.appKeys = append(s.appKeys, key)
+	}
+	sort.Strings(s.orgIDs)
+	sort.Strings(s.envKeys)
+	sort.Strings(s.appKeys)
+	return s
+}
+
+// blindSpots finds the organizations whose contents s doesn't know, with why: those that failed,
+// those listed as sub-organizations but never fetched, such as below MaxDepth, and any of other's
+// organizations that s doesn't have below one of those.
+func (s snapshot) blindSpots(side string, other snapshot) map[string]string {
+	blind := map[string]string{}
+	for _, id := range s.orgIDs {
+		p := s.orgs[id]
+		if p.Error != "" {
+			blind[id] = "failed in the " + side + " snapshot"
+		}
+		for _, sub := range p.BusinessOrganization.SubOrganizationIds {
+			if _, ok := s.orgs[sub]; !ok {
+				blind[sub] = "not fetched in the " + side + " snapshot"
+			}
+		}
+	}
+
+	// Spread to the subtrees, as other has them, until nothing more is found.
+	for grown := true; grown; {
+		grown = false
+		for _, id := range other.orgIDs {
+			reason, ok := blind[id]
+			if !ok {
+				continue
+			}
+			for _, sub := range other.orgs[id].BusinessOrganization.SubOrganizationIds {
+				if _, known := s.orgs[sub]; known {
+					continue
+				}
+				if _, ok := blind[sub]; !ok {
+					if !strings.HasPrefix(reason, "below ") {
+						reason = "below " + id + ", " + reason
+					}
+					blind[sub] = reason
+					grown = true
+				}
+			}
+		}
+	}
+	return blind
+}
+
+// DiffForests compares the trees of an old snapshot against those of a new one.  An organization is
+// only compared where both snapshots know its contents, so one that failed, or wasn't fetched below
+// MaxDepth, doesn't show up as its whole subtree removed or added; those organizations are listed as
+// UncomparedOrganizations, and nothing in them is compared.  Likewise, applications are only compared
+// in environments fetched successfully in both, and the others are listed as Uncompared.
+func DiffForests(old, new []*Node) *Diff {
+	before, after := indexSnapshot(old), indexSnapshot(new)
+	d := &Diff{}
+
+	blindBefore, blindAfter := before.blindSpots("old", after), after.blindSpots("new", before)
+	blind := map[string]bool{}
+	var ids []string
+	for id := range blindBefore {
+		ids = append(ids, id)
+	}
+	for id := range blindAfter {
+		if _, ok := blindBefore[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if (before.orgs[id] == nil) && (after.orgs[id] == nil) {
+			continue // Unknown to both, so there's nothing to compare
+		}
+		var reasons []string
+		for _, reason := range []string{blindBefore[id], blindAfter[id]} {
+			if reason != "" {
+				reasons = append(reasons, reason)
+			}
+		}
+		blind[id] = true
+		ref := orgRef(knownOrg(before.orgs[id], after.orgs[id]))
+		ref.Reason = strings.Join(reasons, ", ")
+		d.UncomparedOrganizations = append(d.UncomparedOrganizations, ref)
+	}
+
+	for _, id := range after.orgIDs {
+		if _, ok := before.orgs[id]; !ok && !blind[id] {
+			d.AddedOrganizations = append(d.AddedOrganizations, orgRef(after.orgs[id]))
+		}
+	}
+	for _, id := range before.orgIDs {
+		if _, ok := after.orgs[id]; !ok && !blind[id] {
+			d.RemovedOrganizations = append(d.RemovedOrganizations, orgRef(before.orgs[id]))
+		}
+	}
+
+	uncompared := map[string]bool{}
+	for _, key := range after.envKeys {
+		e := after.envs[key]
+		if blind[e.org.BusinessOrganization.ID] {
+			continue
+		}
+		b, ok := before.envs[key]
+		if !ok {
+			d.AddedEnvironments = append(d.AddedEnvironments, envRef(e, ""))
+			continue
+		}
+		if reason := uncomparedReason(b.environment, e.environment); reason != "" {
+			uncompared[key] = true
+			d.Uncompared = append(d.Uncompared, envRef(e, reason))
+		}
+	}
+	for _, key := range before.envKeys {
+		if _, ok := after.envs[key]; !ok && !blind[before.envs[key].org.BusinessOrganization.ID] {
+			d.RemovedEnvironments = append(d.RemovedEnvironments, envRef(before.envs[key], ""))
+		}
+	}
+
+	for _, key := range after.appKeys {
+		app := after.apps[key]
+		if blind[app.OrgID] || uncompared[app.OrgID+"/"+app.EnvironmentID] {
+			continue
+		}
+		was, ok := before.apps[key]
+		if !ok {
+			d.Added = append(d.Added, app)
+			continue
+		}
+		if changes := diffApplications(&was.Application, &app.Application); changes != nil {
+			d.Changed = append(d.Changed, ApplicationChange{FlatApplication: app, Changes: changes})
+		}
+	}
+	for _, key := range before.appKeys {
+		app := before.apps[key]
+		if blind[app.OrgID] || uncompared[app.OrgID+"/"+app.EnvironmentID] {
+			continue
+		}
+		if _, ok := after.apps[key]; !ok {
+			d.Removed = append(d.Removed, app)
+		}
+	}
+	return d
+}
+
+// DiffTrees compares a single old tree against a new one, as DiffForests does.
+func DiffTrees(old, new *Node) *Diff {
+	return DiffForests([]*Node{old}, []*Node{new})
+}
+
+// uncomparedReason explains why the applications of an environment in both snapshots can't be
+// compared, or returns "" if they can.
+func uncomparedReason(old, new *Environment) string {
+	var reasons []string
+	for _, side := range []struct {
+		name        string
+		environment *Environment
+	}{{"old", old}, {"new", new}} {
+		switch {
+		case side.environment.Skipped:
+			reasons = append(reasons, "skipped in the "+side.name+" snapshot")
+		case side.environment.Error != "":
+			reasons = append(reasons, "failed in the "+side.name+" snapshot")
+		case side.environment.Applications == nil:
+			reasons = append(reasons, "not fetched in the "+side.name+" snapshot")
+		}
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// diffApplications lists the fields that differ between two versions of an application, or returns
+// nil if none do.
+func diffApplications(old, new *Application) []FieldChange {
+	var changes []FieldChange
+	compare := func(field, o, n string) {
+		if o != n {
+			changes = append(changes, FieldChange{Field: field, Old: o, New: n})
+		}
+	}
+	compare("Status", old.Status, new.Status)
+	compare("WorkerType", old.Workers.Type.CPU, new.Workers.Type.CPU)
+	compare("WorkerAmount", workerAmount(old), workerAmount(new))
+	compare("MuleVersion", old.MuleVersion.Version, new.MuleVersion.Version)
+	compare("FileName", old.FileName, new.FileName)
+	compare("LastUpdated", lastUpdated(old), lastUpdated(new))
+	return changes
+}
+
+// workerAmount is a's worker amount, or empty if it's unknown.
+func workerAmount(a *Application) string {
+	if n, ok := a.WorkerAmount(); ok {
+		return strconv.FormatInt(n, 10)
+	}
+	return ""
+}
+
+// lastUpdated is a's update time as RFC3339, worked out from LastUpdateTime rather than read from
+// LastUpdated, which snapshots written before it existed don't have.
+func lastUpdated(a *Application) string {
+	if t, ok := a.LastUpdate(); ok {
+		return t.Format(time.RFC3339)
+	}
+	return ""
+}
+
+// knownOrg picks whichever of an organization's nodes in the two snapshots, either of which may be
+// nil, was fetched, so its name is known, preferring the new one.
+func knownOrg(old, new *Node) *Node {
+	if (new != nil) && ((new.Error == "") || (old == nil)) {
+		return new
+	}
+	return old
+}
+
+func orgRef(p *Node) OrganizationRef {
+	return OrganizationRef{OrgID: p.BusinessOrganization.ID, OrgName: p.BusinessOrganization.Name}
+}
+
+func envRef(e envEntry, reason string) EnvironmentRef {
+	return EnvironmentRef{
+		OrgID:           e.org.BusinessOrganization.ID,
+		OrgName:         e.org.BusinessOrganization.Name,
+		EnvironmentID:   e.environment.ID,
+		EnvironmentName: e.environment.Name,
+		Reason:          reason,
+	}
+}
+
+// PrintDiff writes d to w, one line per difference: + for added, - for removed, ~ for changed, and
+// ? for organizations and environments that couldn't be compared.
+func PrintDiff(d *Diff, w io.Writer) {
+	for _, o := range d.AddedOrganizations {
+		fmt.Fprintf(w, "+ organization %s (%s)\n", o.OrgName, o.OrgID)
+	}
+	for _, o := range d.RemovedOrganizations {
+		fmt.Fprintf(w, "- organization %s (%s)\n", o.OrgName, o.OrgID)
+	}
+	for _, o := range d.UncomparedOrganizations {
+		fmt.Fprintf(w, "? organization %s (%s): %s\n", o.OrgName, o.OrgID, o.Reason)
+	}
+	for _, e := range d.AddedEnvironments {
+		fmt.Fprintf(w, "+ environment %s\n", e)
+	}
+	for _, e := range d.RemovedEnvironments {
+		fmt.Fprintf(w, "- environment %s\n", e)
+	}
+	for _, e := range d.Uncompared {
+		fmt.Fprintf(w, "? environment %s: %s\n", e, e.Reason)
+	}
+	for _, app := range d.Added {
+		fmt.Fprintf(w, "+ %s\n", appLabel(app))
+	}
+	for _, app := range d.Removed {
+		fmt.Fprintf(w, "- %s\n", appLabel(app))
+	}
+	for _, c := range d.Changed {
+		var fields []string
+		for _, f := range c.Changes {
+			fields = append(fields, fmt.Sprintf("%s %q -> %q", f.Field, f.Old, f.New))
+		}
+		fmt.Fprintf(w, "~ %s: %s\n", appLabel(c.FlatApplication), strings.Join(fields, ", "))
+	}
+}
+
+// String renders e as "Prod (e1) of root (1)".
+func (e EnvironmentRef) String() string {
+	return fmt.Sprintf("%s (%s) of %s (%s)", e.EnvironmentName, e.EnvironmentID, e.OrgName, e.OrgID)
+}
+
+func appLabel(app FlatApplication) string {
+	return fmt.Sprintf("%s in %s (%s) of %s (%s)", app.Domain, app.EnvironmentName, app.EnvironmentID, app.OrgName, app.OrgID)
+}
@@ -0,0 +1,114 @@
+package tree
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// RenderDOT writes the organization hierarchy of roots to w as a Graphviz digraph, one node per
+// organization, labeled with its name, environment count and, once ComputeUsage has run, subtree
+// usage.  Node IDs are the organization IDs, quoted, so names never need to be valid DOT.  An org
+// listed under more than one parent is drawn once, with an edge from each of them.
+func RenderDOT(roots []*Node, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph organizations {")
+	fmt.Fprintln(bw, "\tnode [shape=box];")
+
+	nodes := map[string]*Node{}
+	var order []*Node
+	var collect func(p *Node)
+	collect = func(p *Node) {
+		if _, ok := nodes[p.BusinessOrganization.ID]; !ok {
+			order = append(order, p)
+		}
+		nodes[p.BusinessOrganization.ID] = p
+		for _, c := range p.Children {
+			collect(c)
+		}
+	}
+	for _, root := range roots {
+		collect(root)
+	}
+
+	for _, p := range order {
+		attrs := fmt.Sprintf("label=%s", dotQuote(dotLabel(p)))
+		if p.Error != "" {
+			attrs += ", style=dashed"
+		}
+		fmt.Fprintf(bw, "\t%s [%s];\n", dotQuote(p.BusinessOrganization.ID), attrs)
+	}
+
+	// Edges come from SubOrganizationIds rather than Children, which hold each org under its first
+	// parent only.  Sub-orgs that were never fetched, such as those below MaxDepth, have no node.
+	edges := map[[2]string]bool{}
+	for _, p := range order {
+		parent := p.BusinessOrganization.ID
+		for _, child := range p.BusinessOrganization.SubOrganizationIds {
+			edge := [2]string{parent, child}
+			if _, ok := nodes[child]; !ok || edges[edge] {
+				continue
+			}
+			edges[edge] = true
+			fmt.Fprintf(bw, "\t%s -> %s;\n", dotQuote(parent), dotQuote(child))
+		}
+	}
+
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// dotLabel is the text of p's DOT node, one fact per line.
+func dotLabel(p *Node) string {
+	if p.Error != "" {
+		return p.BusinessOrganization.ID + "\n(failed)"
+	}
+	lines := []string{p.BusinessOrganization.Name, fmt.Sprintf("%d environments", len(p.BusinessOrganization.Environments))}
+	if p.SubtreeUsage != nil {
+		lines = append(lines, p.SubtreeUsage.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// dotQuote renders s as a DOT quoted string, escaping the characters that would end it early.
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
+
+// RenderASCII writes the organization hierarchy of roots to w as an indented tree drawn in plain
+// ASCII, organizations only, each with its environment count and, once ComputeUsage has run,
+// subtree usage.  PrintTree draws the environments and applications as well.
+func RenderASCII(roots []*Node, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var walk func(p *Node, indent string)
+	walk = func(p *Node, indent string) {
+		for i, c := range p.Children {
+			branch, next := "|-- ", "|   "
+			if i == len(p.Children)-1 {
+				branch, next = "`-- ", "    "
+			}
+			fmt.Fprintln(bw, indent+branch+asciiLabel(c))
+			walk(c, indent+next)
+		}
+	}
+	for _, root := range roots {
+		fmt.Fprintln(bw, asciiLabel(root))
+		walk(root, "")
+	}
+	return bw.Flush()
+}
+
+func asciiLabel(p *Node) string {
+	if p.Error != "" {
+		return orgLabel(p)
+	}
+	label := fmt.Sprintf("%s, %d environments", orgLabel(p), len(p.BusinessOrganization.Environments))
+	if p.SubtreeUsage != nil {
+		label += ", " + p.SubtreeUsage.String()
+	}
+	return label
+}
@@ -0,0 +1,73 @@
+package tree
+
+import "time"
+
+// StaleOrganization lists the stale applications of one organization, by environment.
+type StaleOrganization struct {
+	OrgID        string
+	OrgName      string
+	Environments []StaleEnvironment
+}
+
+// StaleEnvironment lists the stale applications of one environment.
+type StaleEnvironment struct {
+	EnvironmentID   string
+	EnvironmentName string
+	Applications    []StaleApplication
+}
+
+// StaleApplication is an application that hasn't been updated within the cutoff.
+type StaleApplication struct {
+	Domain      string
+	Status      string
+	LastUpdated string // RFC3339, or "never/unknown" when the platform reported no update time
+	AgeDays     *int   `json:",omitempty"` // Whole days between LastUpdated and now, unset when unknown
+}
+
+// staleUnknown stands in for the LastUpdated of an application with no update time.
+const staleUnknown = "never/unknown"
+
+// StaleApplications returns every application in the tree last updated more than maxAge before now,
+// grouped by organization and environment in tree order.  An application with no update time is
+// included as never/unknown, since it can't be shown to be fresh.  Passing the same now for every
+// tree keeps a report consistent however long the run took.
+func StaleApplications(root *Node, now time.Time, maxAge time.Duration) []StaleOrganization {
+	orgs := []StaleOrganization{}
+	var walk func(p *Node)
+	walk = func(p *Node) {
+		var environments []StaleEnvironment
+		for _, environment := range p.BusinessOrganization.Environments {
+			var apps []StaleApplication
+			for _, app := range environment.Applications {
+				updated, ok := app.LastUpdate()
+				switch {
+				case !ok:
+					apps = append(apps, StaleApplication{Domain: app.Domain, Status: app.Status, LastUpdated: staleUnknown})
+				case now.Sub(updated) > maxAge:
+					days := int(now.Sub(updated).Hours() / 24)
+					apps = append(apps, StaleApplication{Domain: app.Domain, Status: app.Status, LastUpdated: updated.Format(time.RFC3339), AgeDays: &days})
+				}
+			}
+			if apps != nil {
+				environments = append(environments, StaleEnvironment{
+					EnvironmentID:   environment.ID,
+					EnvironmentName: environment.Name,
+					Applications:    apps,
+				})
+			}
+		}
+		if environments != nil {
+			orgs = append(orgs, StaleOrganization{
+				OrgID:        p.BusinessOrganization.ID,
+				OrgName:      p.BusinessOrganization.Name,
+				Environments: environments,
+			})
+		}
+
+		for _, c := range p.Children {
+			walk(c)
+		}
+	}
+	walk(root)
+	return orgs
+}
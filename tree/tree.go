@@ -0,0 +1,905 @@
+// Package tree builds the Anypoint Platform organization hierarchy, with the environments and
+// CloudHub applications of each organization.
+package tree
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Node is a type that contains Organization data as well as a list of references to children Nodes.
+type Node struct {
+	mux                  sync.Mutex // For locking Children Node array
+	parent               *Node      // Nil for the root
+	BusinessOrganization Organization
+	Children             []*Node
+	Error                string `json:",omitempty"` // Set when the organization couldn't be fetched
+	Usage                *Usage `json:",omitempty"` // The organization's own usage, set by ComputeUsage
+	SubtreeUsage         *Usage `json:",omitempty"` // Usage including every sub-organization, set by ComputeUsage
+}
+
+// Usage totals the workers consumed by applications, overall and by worker CPU type.
+type Usage struct {
+	Workers int64
+	VCores  float64          // Summed from worker CPU types that give a size, e.g. "0.1 vCores"
+	ByType  map[string]int64 // Workers by CPU type
+}
+
+func (u *Usage) add(cpu string, workers int64) {
+	u.Workers += workers
+	if fields := strings.Fields(cpu); len(fields) > 0 {
+		if size, err := strconv.ParseFloat(fields[0], 64); err == nil {
+			u.VCores = roundVCores(u.VCores + size*float64(workers))
+		}
+	}
+	if u.ByType == nil {
+		u.ByType = make(map[string]int64)
+	}
+	u.ByType[cpu] += workers
+}
+
+func (u *Usage) addUsage(o *Usage) {
+	u.Workers += o.Workers
+	u.VCores = roundVCores(u.VCores + o.VCores)
+	for cpu, workers := range o.ByType {
+		if u.ByType == nil {
+			u.ByType = make(map[string]int64)
+		}
+		u.ByType[cpu] += workers
+	}
+}
+
+// roundVCores drops the float error that summing fractional sizes like 0.1 accumulates.
+func roundVCores(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// String renders the usage for a summary, e.g. "5 workers, 0.7 vCores (0.1 vCores: 3, 0.2 vCores: 2)".
+func (u *Usage) String() string {
+	var types []string
+	for cpu := range u.ByType {
+		types = append(types, cpu)
+	}
+	sort.Strings(types)
+	for i, cpu := range types {
+		types[i] = fmt.Sprintf("%s: %d", cpu, u.ByType[cpu])
+	}
+
+	s := fmt.Sprintf("%d workers, %s vCores", u.Workers, strconv.FormatFloat(u.VCores, 'f', -1, 64))
+	if len(types) > 0 {
+		s += " (" + strings.Join(types, ", ") + ")"
+	}
+	return s
+}
+
+// Depth is the number of levels between the node and the root, which is at depth 0.
+func (p *Node) Depth() int {
+	depth := 0
+	for n := p.parent; n != nil; n = n.parent {
+		depth++
+	}
+	return depth
+}
+
+// Normalize sorts the tree in place so that it marshals the same way every run: children by name,
+// then ID, since the tree build appends them in whatever order their fetches finish, sub-organization
+// IDs, which the platform doesn't list in a fixed order, and each environment's applications by domain.
+func (p *Node) Normalize() {
+	sort.Strings(p.BusinessOrganization.SubOrganizationIds)
+	sort.SliceStable(p.Children, func(i, j int) bool {
+		a, b := p.Children[i].BusinessOrganization, p.Children[j].BusinessOrganization
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+	for _, environment := range p.BusinessOrganization.Environments {
+		sort.SliceStable(environment.Applications, func(i, j int) bool {
+			return environment.Applications[i].Domain < environment.Applications[j].Domain
+		})
+	}
+
+	for _, c := range p.Children {
+		c.Normalize()
+	}
+}
+
+// Organization is a type that contains an Organizations Name and ID, as well as a list of sub-Organizations.
+type Organization struct {
+	Name               string
+	ID                 string
+	SubOrganizationIds []string
+	Environments       []*Environment
+}
+
+// Environment is a type that contains an Environemnt Name and ID.
+type Environment struct {
+	ID           string
+	Name         string
+	Type         string `json:",omitempty"` // e.g. production, sandbox, or design
+	Applications []*Application
+	Error        string `json:",omitempty"` // Set when the applications couldn't be fetched
+	Skipped      bool   `json:",omitempty"` // Set when excluded by an EnvironmentFilter, so has no applications
+}
+
+// EnvironmentFilter selects environments by name or ID, and by type.  An empty list matches any
+// environment, so the zero value matches them all.
+type EnvironmentFilter struct {
+	Names []string // Environment names, matched case-insensitively, or IDs
+	Types []string // Environment types, matched case-insensitively
+}
+
+// Match reports whether environment is selected by f.
+func (f EnvironmentFilter) Match(environment *Environment) bool {
+	return matchAny(f.Names, environment.Name, environment.ID) && matchAny(f.Types, environment.Type)
+}
+
+// matchAny reports whether any of values equals one of want, ignoring case, or want is empty.
+func matchAny(want []string, values ...string) bool {
+	if len(want) == 0 {
+		return true
+	}
+	for _, w := range want {
+		for _, v := range values {
+			if strings.EqualFold(w, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Application is a type that contains an Application Domain, Full Domain, Status, and File Name.
+type Application struct {
+	Domain     string
+	FullDomain string
+	Status     string
+	FileName   string
+	Workers    struct {
+		Type struct {
+			CPU string
+		} `json:"type"`
+		Amount              FlexibleInt
+		AmountUnknown       bool `json:",omitempty"` // Set when the platform sent a non-numeric amount, so Amount's 0 means unknown
+		RemainingOrgWorkers float32
+		TotalOrgWorkers     float32
+	} `json:"workers"`
+	LastUpdateTime FlexibleInt // Epoch milliseconds
+	LastUpdated    string      `json:",omitempty"` // LastUpdateTime as RFC3339 in UTC, unset when that's 0
+	MuleVersion    struct {
+		Version string
+	} `json:"muleVersion"`
+}
+
+// setLastUpdated fills in LastUpdated from LastUpdateTime.  It's a plain field set whenever
+// applications are decoded, rather than the work of a MarshalJSON method, because Application is
+// embedded in FlatApplication, which would then marshal as the Application alone.
+func (a *Application) setLastUpdated() {
+	a.LastUpdated = ""
+	if t, ok := a.LastUpdate(); ok {
+		a.LastUpdated = t.Format(time.RFC3339)
+	}
+}
+
+// LastUpdate returns LastUpdateTime as a time in UTC, or false if it's unknown.
+func (a *Application) LastUpdate() (time.Time, bool) {
+	if a.LastUpdateTime == 0 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(int64(a.LastUpdateTime)).UTC(), true
+}
+
+// WorkerAmount returns Workers.Amount, or false if it's unknown.
+func (a *Application) WorkerAmount() (int64, bool) {
+	return int64(a.Workers.Amount), !a.Workers.AmountUnknown
+}
+
+// FlatApplication is an Application together with the Organization and Environment it's deployed in.
+type FlatApplication struct {
+	RootOrgID       string // The root of the tree the organization belongs to
+	OrgName         string
+	OrgID           string
+	EnvironmentName string
+	EnvironmentID   string
+	OrgUsage        *Usage `json:",omitempty"`
+	OrgSubtreeUsage *Usage `json:",omitempty"`
+	Application
+}
+
+// FlexibleInt is an integer that decodes from a JSON number, a quoted number, or null, since some
+// tenancies send numeric fields as strings.  Anything else, including NaN and infinities, decodes to
+// zero instead of failing the whole object, and the Client that fetched it raises WarnNonNumeric.  A
+// number with a fraction is truncated toward zero.  It always marshals as a plain number.
+type FlexibleInt int64
+
+// UnmarshalJSON implements json.Unmarshaler.  null leaves n unchanged.
+func (n *FlexibleInt) UnmarshalJSON(b []byte) error {
+	if string(bytes.TrimSpace(b)) == "null" {
+		return nil
+	}
+	v, _, _ := parseFlexibleInt(b)
+	*n = FlexibleInt(v)
+	return nil
+}
+
+// parseFlexibleInt parses the JSON of a FlexibleInt, reporting ok false if it isn't a number, a quoted
+// number, or null, and truncated true if it's a number with a fraction.
+func parseFlexibleInt(b []byte) (v int64, truncated, ok bool) {
+	s := string(bytes.TrimSpace(b))
+	if s == "null" {
+		return 0, false, true
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return v, false, true
+	}
+	// ParseFloat accepts NaN, Inf and values beyond int64, none of which convert to one.  The range
+	// check rules them all out.
+	if f, err := strconv.ParseFloat(s, 64); (err == nil) && (f >= math.MinInt64) && (f < math.MaxInt64) {
+		return int64(f), f != math.Trunc(f), true
+	}
+	return 0, false, false
+}
+
+// The pipeline stages that record Decisions, in the order they run.
+const (
+	StageBuild        = "build"        // Fetching the organization tree
+	StageEnvironments = "environments" // SkipEnvironments
+	StageFetch        = "fetch"        // Fetching the applications of each environment
+	StageStatus       = "status"       // FilterApplicationsByStatus
+)
+
+// Decision records one step of the pipeline that affected an organization, an environment, or, when
+// Domain is set, an application.  Decisions without a Domain are only made about organizations and
+// environments whose applications aren't known, so any application may have been among them.
+type Decision struct {
+	Stage           string
+	Outcome         string // excluded, kept, failed, or not fetched
+	OrgID           string
+	OrgName         string `json:",omitempty"`
+	EnvironmentID   string `json:",omitempty"`
+	EnvironmentName string `json:",omitempty"`
+	Domain          string `json:",omitempty"`
+	Reason          string
+}
+
+// String renders d as one line, e.g. "[status] excluded app1 in Prod (e1) of root (1): ...".
+func (d Decision) String() string {
+	subject := d.OrgID
+	if d.OrgName != "" {
+		subject = fmt.Sprintf("%s (%s)", d.OrgName, d.OrgID)
+	}
+	if d.EnvironmentID != "" {
+		subject = fmt.Sprintf("%s (%s) of %s", d.EnvironmentName, d.EnvironmentID, subject)
+	}
+	if d.Domain != "" {
+		subject = fmt.Sprintf("%s in %s", d.Domain, subject)
+	}
+	return fmt.Sprintf("[%s] %s %s: %s", d.Stage, d.Outcome, subject, d.Reason)
+}
+
+// environmentDecision returns a Decision about environment, in the org of p.
+func environmentDecision(stage, outcome string, p *Node, environment *Environment, reason string) Decision {
+	return Decision{
+		Stage:           stage,
+		Outcome:         outcome,
+		OrgID:           p.BusinessOrganization.ID,
+		OrgName:         p.BusinessOrganization.Name,
+		EnvironmentID:   environment.ID,
+		EnvironmentName: environment.Name,
+		Reason:          reason,
+	}
+}
+
+// errorList collects the errors reported by concurrent goroutines.
+type errorList struct {
+	mux  sync.Mutex // For locking errs
+	errs []error
+}
+
+func (l *errorList) add(err error) {
+	l.mux.Lock()
+	l.errs = append(l.errs, err)
+	l.mux.Unlock()
+}
+
+// err combines the collected errors, or returns nil if there weren't any.
+func (l *errorList) err() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	return errors.Join(l.errs...)
+}
+
+// visitedOrgs records the organizations claimed by the tree build.  An org can be listed under more
+// than one parent, and a cycle would otherwise never terminate, so each is expanded only under the
+// first parent to claim it.
+type visitedOrgs struct {
+	mux     sync.Mutex          // For locking parents
+	parents map[string][]string // Every parent that referenced each org, the first being the one kept
+}
+
+// claim records parent's reference to id and reports whether it was the first.
+func (v *visitedOrgs) claim(id, parent string) bool {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if v.parents == nil {
+		v.parents = make(map[string][]string)
+	}
+	v.parents[id] = append(v.parents[id], parent)
+	return len(v.parents[id]) == 1
+}
+
+// warnDuplicates warns about every org that was referenced more than once, with the parents that
+// did so.
+func (v *visitedOrgs) warnDuplicates(warnf WarnFunc) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	var ids []string
+	for id, parents := range v.parents {
+		if len(parents) > 1 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		parents := v.parents[id]
+		kept := parents[0]
+		if kept == "" {
+			kept = "the root"
+		}
+		warn(warnf, WarnDuplicateOrg, "organization %s is also listed under %s, kept only under %s", id, strings.Join(parents[1:], ", "), kept)
+	}
+}
+
+// InitTree builds the organization hierarchy under rootID.  If the root organization can't be
+// fetched no tree is returned; otherwise any sub-organizations that failed are marked in the tree and
+// their errors combined into the returned error.
+func (c *Client) InitTree(ctx context.Context, rootID string) (*Node, error) {
+	g := &sync.WaitGroup{}
+	errs := &errorList{}
+	visited := &visitedOrgs{}
+	visited.claim(rootID, "")
+
+	// Construct root Node
+	organization, err := c.getOrganizationMetrics(ctx, rootID)
+	if err != nil {
+		return nil, err
+	}
+	node := &Node{BusinessOrganization: organization, Children: nil}
+
+	// Build remaining Nodes
+	g.Add(1)
+	c.buildOrgTree(ctx, node, 0, g, errs, visited)
+	g.Wait()
+	visited.warnDuplicates(c.Warnf)
+
+	return node, errs.err()
+}
+
+// InitForest builds the organization hierarchy under each of rootIDs concurrently, within the same
+// limit as a single tree, one tree per root, returned in the order given.  Roots that can't be
+// fetched are left out; the errors of every tree are combined into the returned error.
+func (c *Client) InitForest(ctx context.Context, rootIDs []string) ([]*Node, error) {
+	g := &sync.WaitGroup{}
+	errs := &errorList{}
+	trees := make([]*Node, len(rootIDs))
+	for i, id := range rootIDs {
+		i, id := i, id
+		g.Add(1)
+		c.spawn(func() {
+			defer g.Done()
+			node, err := c.InitTree(ctx, id)
+			if err != nil {
+				errs.add(err)
+			}
+			trees[i] = node
+		})
+	}
+	g.Wait()
+
+	roots := []*Node{}
+	for _, node := range trees {
+		if node != nil {
+			roots = append(roots, node)
+		}
+	}
+	return roots, errs.err()
+}
+
+// RetryFailures repairs a tree loaded from an earlier run in place.  It fetches the organizations
+// that failed again, keeping whatever was fetched below them before, along with any sub-organizations
+// that were never fetched because the run was cancelled, and then the applications of every
+// environment that failed or was never reached.  Everything that was fetched successfully before is
+// kept as it is.  Whatever fails again stays marked, and the errors are combined into the returned
+// error.
+func (c *Client) RetryFailures(ctx context.Context, root *Node) error {
+	g := &sync.WaitGroup{}
+	errs := &errorList{}
+	visited := &visitedOrgs{}
+	visited.claim(root.BusinessOrganization.ID, "")
+
+	// Claim every org already in the tree so buildOrgTree only fetches the missing ones.
+	var nodes, failed []*Node
+	var walk func(p *Node)
+	walk = func(p *Node) {
+		nodes = append(nodes, p)
+		if p.Error != "" {
+			failed = append(failed, p)
+		}
+		for _, child := range p.Children {
+			visited.claim(child.BusinessOrganization.ID, p.BusinessOrganization.ID)
+			walk(child)
+		}
+	}
+	walk(root)
+
+	for _, p := range failed {
+		p := p
+		g.Add(1)
+		c.spawn(func() {
+			defer g.Done()
+			organization, err := c.getOrganizationMetrics(ctx, p.BusinessOrganization.ID)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				errs.add(err)
+				if c.Explain != nil {
+					c.Explain(Decision{Stage: StageBuild, Outcome: "failed", OrgID: p.BusinessOrganization.ID, Reason: err.Error()})
+				}
+				p.Error = err.Error()
+				return
+			}
+			p.BusinessOrganization = organization
+			p.Error = ""
+		})
+	}
+	g.Wait()
+
+	for _, p := range nodes {
+		if p.Error != "" {
+			continue
+		}
+		p := p
+		g.Add(1)
+		c.spawn(func() { c.buildOrgTree(ctx, p, p.Depth(), g, errs, visited) })
+	}
+	g.Wait()
+	visited.warnDuplicates(c.Warnf)
+
+	if err := c.GenerateApplications(ctx, root); err != nil {
+		errs.add(err)
+	}
+	return errs.err()
+}
+
+// LoadTree reads a tree back from a metrics.json written by an earlier run.
+func LoadTree(path string) (*Node, error) {
+	roots, err := LoadForest(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(roots) != 1 {
+		return nil, fmt.Errorf("loading %s: %d trees, want one", path, len(roots))
+	}
+	return roots[0], nil
+}
+
+// LoadForest reads the trees back from a metrics.json written by an earlier run, which holds either
+// a single tree or, for a run with several roots, an array of them.
+func LoadForest(path string) ([]*Node, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var roots []*Node
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		err = json.Unmarshal(b, &roots)
+	} else {
+		var node Node
+		err = json.Unmarshal(b, &node)
+		roots = []*Node{&node}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %w", path, err)
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("loading %s: no trees, want a metrics.json", path)
+	}
+	for _, node := range roots {
+		if (node == nil) || (node.BusinessOrganization.ID == "") {
+			return nil, fmt.Errorf("loading %s: no root organization, want a metrics.json tree", path)
+		}
+		linkParents(node)
+	}
+	return roots, nil
+}
+
+// linkParents restores the parent links that aren't part of the JSON encoding, and the LastUpdated
+// fields missing from files written before they existed.
+func linkParents(p *Node) {
+	for _, environment := range p.BusinessOrganization.Environments {
+		for _, app := range environment.Applications {
+			app.setLastUpdated()
+		}
+	}
+	for _, c := range p.Children {
+		c.parent = p
+		linkParents(c)
+	}
+}
+
+// HasApplications reports whether the applications of any environment in the tree were fetched.
+func HasApplications(p *Node) bool {
+	for _, environment := range p.BusinessOrganization.Environments {
+		if environment.Applications != nil {
+			return true
+		}
+	}
+	for _, c := range p.Children {
+		if HasApplications(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildOrgTree fetches the sub-organizations of p, which is depth levels below the root, unless
+// that's already as deep as MaxDepth allows.  Sub-organizations already among p's children are kept.
+func (c *Client) buildOrgTree(ctx context.Context, p *Node, depth int, g *sync.WaitGroup, errs *errorList, visited *visitedOrgs) {
+	defer g.Done()
+	if (c.MaxDepth >= 0) && (depth >= c.MaxDepth) {
+		if (c.Explain != nil) && (len(p.BusinessOrganization.SubOrganizationIds) > 0) {
+			c.Explain(Decision{
+				Stage:   StageBuild,
+				Outcome: "not fetched",
+				OrgID:   p.BusinessOrganization.ID,
+				OrgName: p.BusinessOrganization.Name,
+				Reason: fmt.Sprintf("MaxDepth %d reached, sub-organizations [%s] not fetched", c.MaxDepth,
+					strings.Join(p.BusinessOrganization.SubOrganizationIds, ", ")),
+			})
+		}
+		return
+	}
+	for _, v := range p.BusinessOrganization.SubOrganizationIds {
+		if p.hasChild(v) || !visited.claim(v, p.BusinessOrganization.ID) {
+			continue
+		}
+		organization, err := c.getOrganizationMetrics(ctx, v)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// Keep the org in the tree, marked as failed, rather than dropping its whole subtree silently.
+			errs.add(err)
+			if c.Explain != nil {
+				c.Explain(Decision{Stage: StageBuild, Outcome: "failed", OrgID: v, Reason: err.Error()})
+			}
+			p.mux.Lock()
+			p.Children = append(p.Children, &Node{parent: p, BusinessOrganization: Organization{ID: v}, Error: err.Error()})
+			p.mux.Unlock()
+			continue
+		}
+		node := &Node{parent: p, BusinessOrganization: organization, Children: nil}
+
+		p.mux.Lock()
+		p.Children = append(p.Children, node)
+		p.mux.Unlock()
+
+		g.Add(1)
+		c.spawn(func() { c.buildOrgTree(ctx, node, depth+1, g, errs, visited) })
+	}
+}
+
+// hasChild reports whether the org with the given ID is already one of p's children.
+func (p *Node) hasChild(id string) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for _, child := range p.Children {
+		if child.BusinessOrganization.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchResult locates one deployment of an application in the tree.
+type SearchResult struct {
+	OrganizationName string
+	OrganizationID   string
+	EnvironmentName  string
+	EnvironmentID    string
+	Application      *Application
+}
+
+// SearchForArtifact returns every application in the tree with the given domain.  It only looks at
+// the applications already fetched by GenerateApplications, so it makes no requests of its own.
+func SearchForArtifact(p *Node, domain string) []SearchResult {
+	var results []SearchResult
+	for _, environment := range p.BusinessOrganization.Environments {
+		if environment.Skipped {
+			continue
+		}
+		for _, app := range environment.Applications {
+			if app.Domain == domain {
+				results = append(results, SearchResult{
+					OrganizationName: p.BusinessOrganization.Name,
+					OrganizationID:   p.BusinessOrganization.ID,
+					EnvironmentName:  environment.Name,
+					EnvironmentID:    environment.ID,
+					Application:      app,
+				})
+			}
+		}
+	}
+
+	for _, c := range p.Children {
+		results = append(results, SearchForArtifact(c, domain)...)
+	}
+	return results
+}
+
+// GenerateApplications fetches the applications of every environment in the tree.  Environments that
+// can't be fetched are marked in the tree and their errors combined into the returned error.
+// Environments that already hold their applications, or were marked by SkipEnvironments, are skipped.
+func (c *Client) GenerateApplications(ctx context.Context, p *Node) error {
+	g := &sync.WaitGroup{}
+	errs := &errorList{}
+
+	g.Add(1)
+	c.fetchApplications(ctx, p, g, errs)
+	g.Wait()
+
+	return errs.err()
+}
+
+func (c *Client) fetchApplications(ctx context.Context, p *Node, g *sync.WaitGroup, errs *errorList) {
+	defer g.Done()
+	for _, environment := range p.BusinessOrganization.Environments {
+		if environment.Skipped || (environment.Applications != nil) {
+			continue
+		}
+		applications, err := c.getDeployedArtifacts(ctx, environment.ID)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			errs.add(err)
+			environment.Error = err.Error()
+			if c.Explain != nil {
+				c.Explain(environmentDecision(StageFetch, "failed", p, environment, err.Error()))
+			}
+			continue
+		}
+		environment.Applications = applications
+		environment.Error = ""
+	}
+
+	for _, child := range p.Children {
+		child := child
+		g.Add(1)
+		c.spawn(func() { c.fetchApplications(ctx, child, g, errs) })
+	}
+}
+
+// SkipEnvironments marks every environment in the tree that filter doesn't match as Skipped, dropping
+// any applications it held, so GenerateApplications and SearchForArtifact pass over it.  Skipped
+// environments stay in the tree, marked, rather than looking like they have no applications.
+func (c *Client) SkipEnvironments(root *Node, filter EnvironmentFilter) {
+	for _, environment := range root.BusinessOrganization.Environments {
+		if !filter.Match(environment) {
+			if c.Explain != nil {
+				reason := fmt.Sprintf("name %q, ID %q, and type %q don't match names [%s] and types [%s]",
+					environment.Name, environment.ID, environment.Type,
+					strings.Join(filter.Names, ", "), strings.Join(filter.Types, ", "))
+				// An environment whose applications are known is covered by the decisions about them.
+				if environment.Applications == nil {
+					c.Explain(environmentDecision(StageEnvironments, "excluded", root, environment, reason))
+				}
+				for _, app := range environment.Applications {
+					d := environmentDecision(StageEnvironments, "excluded", root, environment, reason)
+					d.Domain = app.Domain
+					c.Explain(d)
+				}
+			}
+			environment.Skipped = true
+			environment.Applications = nil
+			environment.Error = ""
+		}
+	}
+
+	for _, child := range root.Children {
+		c.SkipEnvironments(child, filter)
+	}
+}
+
+// FilterApplicationsByStatus removes every application whose Status isn't one of statuses, compared
+// case-insensitively, from the tree in place.  No statuses leaves the tree unchanged.
+func (c *Client) FilterApplicationsByStatus(root *Node, statuses []string) {
+	if len(statuses) == 0 {
+		return
+	}
+	for _, environment := range root.BusinessOrganization.Environments {
+		if environment.Applications == nil {
+			continue
+		}
+		kept := []*Application{}
+		for _, app := range environment.Applications {
+			match := matchAny(statuses, app.Status)
+			if match {
+				kept = append(kept, app)
+			}
+			if c.Explain != nil {
+				d := environmentDecision(StageStatus, "kept", root, environment,
+					fmt.Sprintf("status %q is one of [%s]", app.Status, strings.Join(statuses, ", ")))
+				if !match {
+					d.Outcome = "excluded"
+					d.Reason = fmt.Sprintf("status %q is not one of [%s]", app.Status, strings.Join(statuses, ", "))
+				}
+				d.Domain = app.Domain
+				c.Explain(d)
+			}
+		}
+		environment.Applications = kept
+	}
+
+	for _, child := range root.Children {
+		c.FilterApplicationsByStatus(child, statuses)
+	}
+}
+
+// ComputeUsage sets the Usage and SubtreeUsage of every organization in the tree from the
+// applications it currently holds, so it belongs after GenerateApplications and any filtering.
+func ComputeUsage(p *Node) *Usage {
+	p.Usage = &Usage{}
+	for _, environment := range p.BusinessOrganization.Environments {
+		for _, app := range environment.Applications {
+			p.Usage.add(app.Workers.Type.CPU, int64(app.Workers.Amount))
+		}
+	}
+
+	p.SubtreeUsage = &Usage{}
+	p.SubtreeUsage.addUsage(p.Usage)
+	for _, c := range p.Children {
+		p.SubtreeUsage.addUsage(ComputeUsage(c))
+	}
+	return p.SubtreeUsage
+}
+
+// PrintUsage writes a table of every organization's own and subtree usage to w, indented by depth.
+// The usage must already have been computed by ComputeUsage.
+func PrintUsage(root *Node, w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ORGANIZATION\tOWN USAGE\tSUBTREE USAGE")
+	var walk func(p *Node)
+	walk = func(p *Node) {
+		name := p.BusinessOrganization.Name
+		if p.Error != "" {
+			name = p.BusinessOrganization.ID + " (failed)"
+		}
+		fmt.Fprintf(tw, "%s%s\t%s\t%s\n", strings.Repeat("  ", p.Depth()), name, p.Usage, p.SubtreeUsage)
+		for _, c := range p.Children {
+			walk(c)
+		}
+	}
+	walk(root)
+	return tw.Flush()
+}
+
+// PrintTree renders the organization hierarchy to w in the style of tree(1).  Each organization
+// lists its environments, with their applications, ahead of its sub-organizations.
+func PrintTree(root *Node, w io.Writer) {
+	fmt.Fprintln(w, orgLabel(root))
+	printChildren(root, w, "")
+}
+
+func printChildren(p *Node, w io.Writer, indent string) {
+	type entry struct {
+		label string
+		env   *Environment
+		org   *Node
+	}
+	var entries []entry
+	for _, environment := range p.BusinessOrganization.Environments {
+		label := fmt.Sprintf("%s (%d apps)", environment.Name, len(environment.Applications))
+		switch {
+		case environment.Skipped:
+			label = fmt.Sprintf("%s (skipped)", environment.Name)
+		case environment.Error != "":
+			label = fmt.Sprintf("%s (error: %s)", environment.Name, environment.Error)
+		}
+		entries = append(entries, entry{label: label, env: environment})
+	}
+	for _, c := range p.Children {
+		entries = append(entries, entry{label: orgLabel(c), org: c})
+	}
+
+	for i, e := range entries {
+		branch, next := "├── ", "│   "
+		if i == len(entries)-1 {
+			branch, next = "└── ", "    "
+		}
+		fmt.Fprintln(w, indent+branch+e.label)
+
+		switch {
+		case e.env != nil:
+			for j, app := range e.env.Applications {
+				appBranch := "├── "
+				if j == len(e.env.Applications)-1 {
+					appBranch = "└── "
+				}
+				fmt.Fprintf(w, "%s%s%s%s [%s]\n", indent, next, appBranch, app.Domain, app.Status)
+			}
+		case e.org != nil:
+			printChildren(e.org, w, indent+next)
+		}
+	}
+}
+
+func orgLabel(p *Node) string {
+	if p.Error != "" {
+		return fmt.Sprintf("%s (error: %s)", p.BusinessOrganization.ID, p.Error)
+	}
+	return fmt.Sprintf("%s (%s)", p.BusinessOrganization.Name, p.BusinessOrganization.ID)
+}
+
+// FlattenApplications walks the tree depth-first and returns one FlatApplication per deployed
+// application, in the same order on every run once the tree has been normalized.
+func FlattenApplications(p *Node) []FlatApplication {
+	root := p
+	for root.parent != nil {
+		root = root.parent
+	}
+	return flatten(p, root.BusinessOrganization.ID)
+}
+
+// FlattenForest flattens every tree in roots, one after the other.
+func FlattenForest(roots []*Node) []FlatApplication {
+	apps := []FlatApplication{}
+	for _, root := range roots {
+		apps = append(apps, FlattenApplications(root)...)
+	}
+	return apps
+}
+
+func flatten(p *Node, rootID string) []FlatApplication {
+	apps := []FlatApplication{}
+	for _, environment := range p.BusinessOrganization.Environments {
+		for _, app := range environment.Applications {
+			apps = append(apps, FlatApplication{
+				RootOrgID:       rootID,
+				OrgName:         p.BusinessOrganization.Name,
+				OrgID:           p.BusinessOrganization.ID,
+				EnvironmentName: environment.Name,
+				EnvironmentID:   environment.ID,
+				OrgUsage:        p.Usage,
+				OrgSubtreeUsage: p.SubtreeUsage,
+				Application:     *app,
+			})
+		}
+	}
+
+	for _, c := range p.Children {
+		apps = append(apps, flatten(c, rootID)...)
+	}
+	return apps
+}
@@ -0,0 +1,965 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePlatform serves organizations and paged applications from memory, the way the Anypoint API
+// does.  Requests for anything in fail get that status instead.
+type fakePlatform struct {
+	mux  sync.Mutex
+	orgs map[string]Organization
+	apps map[string][]Application // By environment ID
+	fail map[string]int           // By organization or environment ID
+
+	requests []string // The org or environment ID of every request, in order
+}
+
+func (f *fakePlatform) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var id string
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/accounts/api/organizations/"):
+		id = strings.TrimPrefix(r.URL.Path, "/accounts/api/organizations/")
+	case r.URL.Path == "/cloudhub/api/v2/applications":
+		id = r.Header.Get("X-Anypnt-Env-Id")
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f.mux.Lock()
+	f.requests = append(f.requests, id)
+	status, failed := f.fail[id]
+	org, isOrg := f.orgs[id]
+	apps := f.apps[id]
+	f.mux.Unlock()
+
+	switch {
+	case failed:
+		w.WriteHeader(status)
+	case strings.HasPrefix(r.URL.Path, "/accounts/"):
+		if !isOrg {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(org)
+	default:
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		page := []Application{}
+		for i := offset; (i < len(apps)) && (i < offset+limit); i++ {
+			page = append(page, apps[i])
+		}
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// requested returns how many requests were made for id.
+func (f *fakePlatform) requested(id string) int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	n := 0
+	for _, r := range f.requests {
+		if r == id {
+			n++
+		}
+	}
+	return n
+}
+
+// newTestClient returns a Client against a test server running h.
+func newTestClient(t *testing.T, h http.Handler, maxConcurrent int) *Client {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	c := NewClient(srv.Client(), StaticToken("test"), maxConcurrent)
+	c.BaseURL = srv.URL
+	return c
+}
+
+// samplePlatform is a root with two sub-organizations, one of which has one of its own.
+func samplePlatform() *fakePlatform {
+	return &fakePlatform{
+		orgs: map[string]Organization{
+			"root": {Name: "Root", ID: "root", SubOrganizationIds: []string{"a", "b"},
+				Environments: []*Environment{{ID: "root-prod", Name: "Production"}}},
+			"a": {Name: "A", ID: "a", SubOrganizationIds: []string{"a1"},
+				Environments: []*Environment{{ID: "a-prod", Name: "Production"}, {ID: "a-dev", Name: "Sandbox"}}},
+			"a1": {Name: "A1", ID: "a1"},
+			"b":  {Name: "B", ID: "b", Environments: []*Environment{{ID: "b-prod", Name: "Production"}}},
+		},
+		apps: map[string][]Application{
+			"root-prod": {{Domain: "gateway", Status: "STARTED"}},
+			"a-prod":    {{Domain: "orders", Status: "STARTED"}, {Domain: "billing", Status: "STOPPED"}},
+			"a-dev":     {{Domain: "orders", Status: "STARTED"}},
+			"b-prod":    {},
+		},
+		fail: map[string]int{},
+	}
+}
+
+// findOrg returns the node of the org with the given ID, or nil if it isn't in the tree.
+func findOrg(p *Node, id string) *Node {
+	if p.BusinessOrganization.ID == id {
+		return p
+	}
+	for _, c := range p.Children {
+		if found := findOrg(c, id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// orgIDs lists the IDs of every organization in the tree, depth-first.
+func orgIDs(p *Node) []string {
+	ids := []string{p.BusinessOrganization.ID}
+	for _, c := range p.Children {
+		ids = append(ids, orgIDs(c)...)
+	}
+	return ids
+}
+
+func TestInitTree(t *testing.T) {
+	platform := samplePlatform()
+	c := newTestClient(t, platform, 4)
+
+	root, err := c.InitTree(context.Background(), "root")
+	if err != nil {
+		t.Fatalf("InitTree: %v", err)
+	}
+	root.Normalize()
+	if got, want := orgIDs(root), []string{"root", "a", "a1", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("orgs = %v, want %v", got, want)
+	}
+	if got := root.Children[0].Children[0].Depth(); got != 2 {
+		t.Errorf("a1 depth = %d, want 2", got)
+	}
+}
+
+func TestInitTreeMarksFailedOrgs(t *testing.T) {
+	platform := samplePlatform()
+	platform.fail["a"] = http.StatusForbidden
+	c := newTestClient(t, platform, 4)
+
+	root, err := c.InitTree(context.Background(), "root")
+	if err == nil || !strings.Contains(err.Error(), "organization a") {
+		t.Fatalf("InitTree error = %v, want one naming organization a", err)
+	}
+	root.Normalize()
+	if got, want := orgIDs(root), []string{"root", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("orgs = %v, want %v", got, want)
+	}
+	if root.Children[0].Error == "" {
+		t.Errorf("a isn't marked as failed")
+	}
+}
+
+func TestInitTreeRootFails(t *testing.T) {
+	platform := samplePlatform()
+	platform.fail["root"] = http.StatusNotFound
+	c := newTestClient(t, platform, 4)
+
+	root, err := c.InitTree(context.Background(), "root")
+	if (root != nil) || (err == nil) {
+		t.Fatalf("InitTree = %v, %v, want no tree and an error", root, err)
+	}
+}
+
+func TestInitTreeMaxDepth(t *testing.T) {
+	for _, tt := range []struct {
+		maxDepth   int
+		orgs       []string
+		notFetched []string // Orgs that were never requested
+	}{
+		{-1, []string{"root", "a", "a1", "a11", "b"}, nil},
+		{0, []string{"root"}, []string{"a", "a1", "a11", "b"}},
+		{1, []string{"root", "a", "b"}, []string{"a1", "a11"}},
+		{2, []string{"root", "a", "a1", "b"}, []string{"a11"}},
+	} {
+		t.Run(strconv.Itoa(tt.maxDepth), func(t *testing.T) {
+			platform := samplePlatform()
+			platform.orgs["a1"] = Organization{Name: "A1", ID: "a1", SubOrganizationIds: []string{"a11"}}
+			platform.orgs["a11"] = Organization{Name: "A11", ID: "a11"}
+			c := newTestClient(t, platform, 4)
+			c.MaxDepth = tt.maxDepth
+
+			root, err := c.InitTree(context.Background(), "root")
+			if err != nil {
+				t.Fatalf("InitTree: %v", err)
+			}
+			root.Normalize()
+			if got := orgIDs(root); !reflect.DeepEqual(got, tt.orgs) {
+				t.Errorf("orgs = %v, want %v", got, tt.orgs)
+			}
+			for _, id := range tt.notFetched {
+				if n := platform.requested(id); n != 0 {
+					t.Errorf("%s requested %d times, want 0", id, n)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateApplications(t *testing.T) {
+	platform := samplePlatform()
+	platform.fail["a-dev"] = http.StatusForbidden
+	c := newTestClient(t, platform, 4)
+	c.PageSize = 1
+
+	root, err := c.InitTree(context.Background(), "root")
+	if err != nil {
+		t.Fatalf("InitTree: %v", err)
+	}
+	err = c.GenerateApplications(context.Background(), root)
+	if err == nil || !strings.Contains(err.Error(), "environment a-dev") {
+		t.Fatalf("GenerateApplications error = %v, want one naming environment a-dev", err)
+	}
+	root.Normalize()
+
+	a := root.Children[0].BusinessOrganization
+	if got := len(a.Environments[0].Applications); got != 2 {
+		t.Errorf("a-prod has %d applications, want 2 across pages", got)
+	}
+	if (a.Environments[1].Error == "") || (a.Environments[1].Applications != nil) {
+		t.Errorf("a-dev = %+v, want it marked as failed with no applications", a.Environments[1])
+	}
+	if b := root.Children[1].BusinessOrganization.Environments[0]; (b.Applications == nil) || (len(b.Applications) != 0) {
+		t.Errorf("b-prod applications = %#v, want an empty list", b.Applications)
+	}
+
+	// A second call only fetches what's missing.
+	before := platform.requested("a-prod")
+	c.GenerateApplications(context.Background(), root)
+	if after := platform.requested("a-prod"); after != before {
+		t.Errorf("a-prod fetched %d more times, want 0", after-before)
+	}
+	if platform.requested("a-dev") < 2 {
+		t.Errorf("a-dev wasn't fetched again")
+	}
+}
+
+func TestSkipEnvironmentsExplain(t *testing.T) {
+	c := newTestClient(t, samplePlatform(), 4)
+	var got []string
+	c.Explain = func(d Decision) {
+		got = append(got, strings.Join([]string{d.Stage, d.Outcome, d.EnvironmentID, d.Domain}, " "))
+	}
+
+	root, err := c.InitTree(context.Background(), "root")
+	if err != nil {
+		t.Fatalf("InitTree: %v", err)
+	}
+	if err := c.GenerateApplications(context.Background(), root); err != nil {
+		t.Fatalf("GenerateApplications: %v", err)
+	}
+	root.Normalize()
+	root.BusinessOrganization.Environments[0].Applications = nil // As though it was never fetched
+	c.SkipEnvironments(root, EnvironmentFilter{Names: []string{"Sandbox"}})
+
+	// Only the environment whose applications aren't known is decided as a whole; b-prod held none.
+	want := []string{
+		"environments excluded root-prod ",
+		"environments excluded a-prod billing",
+		"environments excluded a-prod orders",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decisions = %q, want %q", got, want)
+	}
+}
+
+func TestSearchForArtifact(t *testing.T) {
+	platform := samplePlatform()
+	c := newTestClient(t, platform, 4)
+	root, err := c.InitTree(context.Background(), "root")
+	if err != nil {
+		t.Fatalf("InitTree: %v", err)
+	}
+	if err := c.GenerateApplications(context.Background(), root); err != nil {
+		t.Fatalf("GenerateApplications: %v", err)
+	}
+	root.Normalize()
+
+	var found []string
+	for _, r := range SearchForArtifact(root, "orders") {
+		found = append(found, r.OrganizationID+"/"+r.EnvironmentID)
+	}
+	if want := []string{"a/a-prod", "a/a-dev"}; !reflect.DeepEqual(found, want) {
+		t.Errorf("orders found in %v, want %v", found, want)
+	}
+	if results := SearchForArtifact(root, "missing"); results != nil {
+		t.Errorf("missing found in %v, want nowhere", results)
+	}
+
+	root.Children[0].BusinessOrganization.Environments[1].Skipped = true
+	if got := len(SearchForArtifact(root, "orders")); got != 1 {
+		t.Errorf("orders found %d times with a-dev skipped, want 1", got)
+	}
+}
+
+func TestNormalizeShuffled(t *testing.T) {
+	// Two orgs named B, so children are ordered by ID as well as name.
+	build := func(seed int64) []byte {
+		platform := samplePlatform()
+		platform.orgs["b2"] = Organization{Name: "B", ID: "b2"}
+		root := platform.orgs["root"]
+		root.SubOrganizationIds = append(root.SubOrganizationIds, "b2")
+		platform.orgs["root"] = root
+
+		rng := rand.New(rand.NewSource(seed))
+		for id, org := range platform.orgs {
+			subs := org.SubOrganizationIds
+			rng.Shuffle(len(subs), func(i, j int) { subs[i], subs[j] = subs[j], subs[i] })
+			platform.orgs[id] = org
+		}
+		for _, apps := range platform.apps {
+			rng.Shuffle(len(apps), func(i, j int) { apps[i], apps[j] = apps[j], apps[i] })
+		}
+
+		c := newTestClient(t, platform, 4)
+		tree, err := c.InitTree(context.Background(), "root")
+		if err != nil {
+			t.Fatalf("InitTree: %v", err)
+		}
+		if err := c.GenerateApplications(context.Background(), tree); err != nil {
+			t.Fatalf("GenerateApplications: %v", err)
+		}
+		tree.Normalize()
+		b, err := json.Marshal(tree)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		return b
+	}
+
+	want := build(1)
+	for seed := int64(2); seed <= 10; seed++ {
+		if got := build(seed); !bytes.Equal(got, want) {
+			t.Fatalf("seed %d marshals as\n%s\nwant\n%s", seed, got, want)
+		}
+	}
+}
+
+func TestFlattenApplications(t *testing.T) {
+	platform := samplePlatform()
+	c := newTestClient(t, platform, 4)
+	root, err := c.InitTree(context.Background(), "root")
+	if err != nil {
+		t.Fatalf("InitTree: %v", err)
+	}
+	if err := c.GenerateApplications(context.Background(), root); err != nil {
+		t.Fatalf("GenerateApplications: %v", err)
+	}
+	root.Normalize()
+
+	var got []string
+	for _, app := range FlattenApplications(root) {
+		got = append(got, strings.Join([]string{app.RootOrgID, app.OrgName, app.EnvironmentName, app.Domain}, "/"))
+	}
+	want := []string{
+		"root/Root/Production/gateway",
+		"root/A/Production/billing",
+		"root/A/Production/orders",
+		"root/A/Sandbox/orders",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FlattenApplications = %v, want %v", got, want)
+	}
+
+	// A subtree is still labeled with the root of the whole tree.
+	for _, app := range FlattenApplications(root.Children[0]) {
+		if app.RootOrgID != "root" {
+			t.Errorf("%s RootOrgID = %q, want root", app.Domain, app.RootOrgID)
+		}
+	}
+}
+
+func TestPrintTree(t *testing.T) {
+	env := func(id, name string, apps ...*Application) *Environment {
+		return &Environment{ID: id, Name: name, Applications: apps}
+	}
+	org := func(id, name string, environments []*Environment, children ...*Node) *Node {
+		return &Node{BusinessOrganization: Organization{ID: id, Name: name, Environments: environments}, Children: children}
+	}
+	sandbox := env("a-dev", "Sandbox")
+	sandbox.Skipped = true
+	denied := env("b-prod", "Production")
+	denied.Error = "HTTP status 403"
+	failed := org("c", "", nil)
+	failed.Error = "HTTP status 404"
+
+	for _, tt := range []struct {
+		name string
+		root *Node
+		want string
+	}{
+		{"root only", org("root", "Root", nil), "Root (root)\n"},
+		{"empty environment", org("root", "Root", []*Environment{env("root-prod", "Production")}), `Root (root)
+└── Production (0 apps)
+`},
+		{"two levels", org("root", "Root", []*Environment{env("root-prod", "Production", &Application{Domain: "gateway", Status: "STARTED"})},
+			org("a", "A", []*Environment{
+				env("a-prod", "Production", &Application{Domain: "orders", Status: "STARTED"}, &Application{Domain: "billing", Status: "STOPPED"}),
+				sandbox,
+			}, org("a1", "A1", nil)),
+			org("b", "B", []*Environment{denied}),
+			failed,
+		), `Root (root)
+├── Production (1 apps)
+│   └── gateway [STARTED]
+├── A (a)
+│   ├── Production (2 apps)
+│   │   ├── orders [STARTED]
+│   │   └── billing [STOPPED]
+│   ├── Sandbox (skipped)
+│   └── A1 (a1)
+├── B (b)
+│   └── Production (error: HTTP status 403)
+└── c (error: HTTP status 404)
+`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			PrintTree(tt.root, &buf)
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffApplications(t *testing.T) {
+	old := &Application{Domain: "orders", Status: "STARTED", FileName: "orders-1.0.jar", LastUpdateTime: 1700000000000}
+	same := *old
+	same.LastUpdated = "2023-11-14T22:13:20Z" // Set on decoding, missing from older snapshots
+	if changes := diffApplications(old, &same); changes != nil {
+		t.Errorf("unchanged application: %v", changes)
+	}
+
+	redeployed := *old
+	redeployed.FileName = "orders-1.1.jar"
+	redeployed.LastUpdateTime = 1700086400000
+	want := []FieldChange{
+		{Field: "FileName", Old: "orders-1.0.jar", New: "orders-1.1.jar"},
+		{Field: "LastUpdated", Old: "2023-11-14T22:13:20Z", New: "2023-11-15T22:13:20Z"},
+	}
+	if changes := diffApplications(old, &redeployed); !reflect.DeepEqual(changes, want) {
+		t.Errorf("redeployed application: %v, want %v", changes, want)
+	}
+}
+
+// diffSnapshot builds root→a→a1→a2 and root→b, with an application in each environment.
+func diffSnapshot() *Node {
+	org := func(id, name string, subs ...string) *Node {
+		return &Node{BusinessOrganization: Organization{ID: id, Name: name, SubOrganizationIds: subs,
+			Environments: []*Environment{{ID: id + "-prod", Name: "Production",
+				Applications: []*Application{{Domain: id + "-app", Status: "STARTED"}}}}}}
+	}
+	root, a, a1, a2, b := org("root", "Root", "a", "b"), org("a", "A", "a1"), org("a1", "A1", "a2"), org("a2", "A2"), org("b", "B")
+	a1.Children = []*Node{a2}
+	a.Children = []*Node{a1}
+	root.Children = []*Node{a, b}
+	return root
+}
+
+func TestDiffForests(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		change func(root *Node) // Turns the old snapshot into the new one
+		want   []string
+	}{
+		{
+			name:   "unchanged",
+			change: func(root *Node) {},
+		},
+		{
+			name: "organizations and environments added and removed",
+			change: func(root *Node) {
+				c := &Node{BusinessOrganization: Organization{ID: "c", Name: "C",
+					Environments: []*Environment{{ID: "c-prod", Name: "Production", Applications: []*Application{}}}}}
+				root.BusinessOrganization.SubOrganizationIds = []string{"a", "c"}
+				root.Children = []*Node{root.Children[0], c}
+				a := root.Children[0].BusinessOrganization
+				a.Environments = append(a.Environments, &Environment{ID: "a-dev", Name: "Sandbox", Applications: []*Application{}})
+				root.Children[0].BusinessOrganization = a
+			},
+			want: []string{
+				"+ organization C (c)",
+				"- organization B (b)",
+				"+ environment Sandbox (a-dev) of A (a)",
+				"+ environment Production (c-prod) of C (c)",
+				"- environment Production (b-prod) of B (b)",
+				"- b-app in Production (b-prod) of B (b)",
+			},
+		},
+		{
+			name: "failed organization",
+			change: func(root *Node) {
+				root.Children[0] = &Node{BusinessOrganization: Organization{ID: "a"}, Error: "HTTP 500"}
+			},
+			want: []string{
+				"? organization A (a): failed in the new snapshot",
+				"? organization A1 (a1): below a, failed in the new snapshot",
+				"? organization A2 (a2): below a, failed in the new snapshot",
+			},
+		},
+		{
+			name: "below MaxDepth",
+			change: func(root *Node) {
+				root.Children[0].Children = nil
+			},
+			want: []string{
+				"? organization A1 (a1): not fetched in the new snapshot",
+				"? organization A2 (a2): below a1, not fetched in the new snapshot",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root := diffSnapshot()
+			tt.change(root)
+
+			var buf bytes.Buffer
+			PrintDiff(DiffTrees(diffSnapshot(), root), &buf)
+			got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if buf.Len() == 0 {
+				got = nil
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestStaleApplications(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	maxAge := 30 * 24 * time.Hour
+	app := func(domain string, updated time.Time) *Application {
+		a := &Application{Domain: domain, Status: "STARTED"}
+		if !updated.IsZero() {
+			a.LastUpdateTime = FlexibleInt(updated.UnixMilli())
+		}
+		return a
+	}
+	days := func(n int) *int { return &n }
+
+	root := &Node{BusinessOrganization: Organization{ID: "root", Name: "Root", Environments: []*Environment{
+		{ID: "e1", Name: "Production", Applications: []*Application{
+			app("exactly-max-age", now.Add(-maxAge)),
+			app("just-over", now.Add(-maxAge-time.Second)),
+			app("old", now.Add(-400*24*time.Hour)),
+			app("future", now.Add(time.Hour)),
+			app("never", time.Time{}),
+		}},
+		{ID: "e2", Name: "Sandbox", Applications: []*Application{app("fresh", now.Add(-time.Hour))}},
+	}}}
+	fresh := &Node{BusinessOrganization: Organization{ID: "a", Name: "A", Environments: []*Environment{
+		{ID: "a-prod", Name: "Production", Applications: []*Application{app("today", now)}},
+	}}}
+	stale := &Node{BusinessOrganization: Organization{ID: "b", Name: "B", Environments: []*Environment{
+		{ID: "b-prod", Name: "Production", Applications: []*Application{app("old", now.Add(-maxAge-24*time.Hour))}},
+	}}}
+	root.Children = []*Node{fresh, stale}
+
+	want := []StaleOrganization{
+		{OrgID: "root", OrgName: "Root", Environments: []StaleEnvironment{{EnvironmentID: "e1", EnvironmentName: "Production", Applications: []StaleApplication{
+			{Domain: "just-over", Status: "STARTED", LastUpdated: "2024-01-31T11:59:59Z", AgeDays: days(30)},
+			{Domain: "old", Status: "STARTED", LastUpdated: "2023-01-26T12:00:00Z", AgeDays: days(400)},
+			{Domain: "never", Status: "STARTED", LastUpdated: "never/unknown"},
+		}}}},
+		{OrgID: "b", OrgName: "B", Environments: []StaleEnvironment{{EnvironmentID: "b-prod", EnvironmentName: "Production", Applications: []StaleApplication{
+			{Domain: "old", Status: "STARTED", LastUpdated: "2024-01-30T12:00:00Z", AgeDays: days(31)},
+		}}}},
+	}
+	got := StaleApplications(root, now, maxAge)
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.MarshalIndent(got, "", "  ")
+		wantJSON, _ := json.MarshalIndent(want, "", "  ")
+		t.Errorf("got\n%s\nwant\n%s", gotJSON, wantJSON)
+	}
+
+	if got := StaleApplications(fresh, now, maxAge); (got == nil) || (len(got) != 0) {
+		t.Errorf("tree with nothing stale = %#v, want an empty list", got)
+	}
+}
+
+// renderSnapshot builds a root whose two sub-orgs share s, held under a, its first parent, as
+// InitTree does.  b also names an org that was never fetched, and c failed.
+func renderSnapshot() *Node {
+	s := &Node{BusinessOrganization: Organization{ID: "s", Name: "Shared"}}
+	a := &Node{BusinessOrganization: Organization{ID: "a", Name: `The "A" team\ops`, SubOrganizationIds: []string{"s"},
+		Environments: []*Environment{{ID: "a-prod"}, {ID: "a-dev"}}}, Children: []*Node{s}}
+	b := &Node{BusinessOrganization: Organization{ID: "b", Name: "B", SubOrganizationIds: []string{"s", "unfetched"}}}
+	c := &Node{BusinessOrganization: Organization{ID: "c"}, Error: "HTTP 403"}
+	return &Node{BusinessOrganization: Organization{ID: "root", Name: "Root", SubOrganizationIds: []string{"a", "b", "c"}},
+		Children: []*Node{a, b, c}}
+}
+
+func TestRenderDOT(t *testing.T) {
+	root := renderSnapshot()
+	root.BusinessOrganization.Name = "Root\nLine"
+	var buf bytes.Buffer
+	if err := RenderDOT([]*Node{root}, &buf); err != nil {
+		t.Fatalf("RenderDOT: %v", err)
+	}
+	want := `digraph organizations {
+	node [shape=box];
+	"root" [label="Root\nLine\n0 environments"];
+	"a" [label="The \"A\" team\\ops\n2 environments"];
+	"s" [label="Shared\n0 environments"];
+	"b" [label="B\n0 environments"];
+	"c" [label="c\n(failed)", style=dashed];
+	"root" -> "a";
+	"root" -> "b";
+	"root" -> "c";
+	"a" -> "s";
+	"b" -> "s";
+}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRenderASCII(t *testing.T) {
+	var buf bytes.Buffer
+	if err := RenderASCII([]*Node{renderSnapshot()}, &buf); err != nil {
+		t.Fatalf("RenderASCII: %v", err)
+	}
+	want := "Root (root), 0 environments\n" +
+		"|-- The \"A\" team\\ops (a), 2 environments\n" +
+		"|   `-- Shared (s), 0 environments\n" +
+		"|-- B (b), 0 environments\n" +
+		"`-- c (error: HTTP 403)\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFlexibleInt(t *testing.T) {
+	for _, tt := range []struct {
+		json      string
+		want      FlexibleInt
+		truncated bool
+		invalid   bool
+	}{
+		{`2`, 2, false, false},
+		{`-7`, -7, false, false},
+		{`1.0`, 1, false, false},
+		{`"3"`, 3, false, false},
+		{`"2.5"`, 2, true, false},
+		{`-0.5`, 0, true, false},
+		{`null`, 99, false, false}, // Left alone, as encoding/json does for a plain int
+		{`"abc"`, 0, false, true},
+		{`""`, 0, false, true},
+		{`true`, 0, false, true},
+		{`{}`, 0, false, true},
+		{`"NaN"`, 0, false, true},
+		{`"Inf"`, 0, false, true},
+		{`"-Infinity"`, 0, false, true},
+		{`"1e300"`, 0, false, true},
+	} {
+		n := FlexibleInt(99)
+		if err := json.Unmarshal([]byte(tt.json), &n); err != nil {
+			t.Errorf("%s: %v", tt.json, err)
+			continue
+		}
+		if n != tt.want {
+			t.Errorf("%s decoded as %d, want %d", tt.json, n, tt.want)
+		}
+		_, truncated, ok := parseFlexibleInt([]byte(tt.json))
+		if ok == tt.invalid {
+			t.Errorf("%s parsed as valid %t, want %t", tt.json, ok, !tt.invalid)
+		}
+		if truncated != tt.truncated {
+			t.Errorf("%s parsed as truncated %t, want %t", tt.json, truncated, tt.truncated)
+		}
+	}
+}
+
+func TestNonNumericWarnings(t *testing.T) {
+	platform := samplePlatform()
+	platform.apps["a-prod"] = []Application{{Domain: "orders"}}
+	body := `[{"domain": "orders", "workers": {"amount": "two"}, "lastUpdateTime": "NaN"}, {"domain": "billing", "workers": {"amount": "2"}},
+		{"domain": "search", "workers": {"amount": "2.5"}}]`
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Anypnt-Env-Id") == "a-prod" {
+			w.Write([]byte(body))
+			return
+		}
+		platform.ServeHTTP(w, r)
+	})
+
+	// Two clients running at once each get their own warnings.
+	g := &sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		g.Add(1)
+		go func() {
+			defer g.Done()
+			c := newTestClient(t, handler, 4)
+			warnings := captureWarnings(c)
+			root, err := c.InitTree(context.Background(), "root")
+			if err != nil {
+				t.Errorf("InitTree: %v", err)
+				return
+			}
+			if err := c.GenerateApplications(context.Background(), root); err != nil {
+				t.Errorf("GenerateApplications: %v", err)
+			}
+			if want := []WarningCode{WarnNonNumeric, WarnNonNumeric, WarnNonNumeric}; !reflect.DeepEqual(*warnings, want) {
+				t.Errorf("warnings = %v, want %v", *warnings, want)
+			}
+			var got []string
+			for _, app := range findOrg(root, "a").BusinessOrganization.Environments[0].Applications {
+				n, ok := app.WorkerAmount()
+				got = append(got, fmt.Sprintf("%s %d %t", app.Domain, n, ok))
+			}
+			if want := []string{"orders 0 false", "billing 2 true", "search 2 true"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("worker amounts %v, want %v", got, want)
+			}
+		}()
+	}
+	g.Wait()
+}
+
+func TestFlexibleIntInApplication(t *testing.T) {
+	var app Application
+	body := `{"domain": "app1", "workers": {"amount": "2", "type": {"cpu": "0.1 vCores"}}, "lastUpdateTime": null}`
+	if err := json.Unmarshal([]byte(body), &app); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if (app.Workers.Amount != 2) || (app.LastUpdateTime != 0) {
+		t.Errorf("amount %d, lastUpdateTime %d, want 2 and 0", app.Workers.Amount, app.LastUpdateTime)
+	}
+
+	out, err := json.Marshal(app.Workers.Amount)
+	if (err != nil) || (string(out) != "2") {
+		t.Errorf("Marshal = %s, %v, want a plain 2", out, err)
+	}
+}
+
+// captureWarnings collects the codes of the warnings c raises.
+func captureWarnings(c *Client) *[]WarningCode {
+	var mux sync.Mutex
+	codes := &[]WarningCode{}
+	c.Warnf = func(code WarningCode, format string, args ...interface{}) {
+		mux.Lock()
+		*codes = append(*codes, code)
+		mux.Unlock()
+	}
+	return codes
+}
+
+func TestInitTreeCycle(t *testing.T) {
+	platform := &fakePlatform{
+		orgs: map[string]Organization{
+			"root": {Name: "Root", ID: "root", SubOrganizationIds: []string{"c1"}},
+			"c1":   {Name: "C1", ID: "c1", SubOrganizationIds: []string{"c2"}},
+			"c2":   {Name: "C2", ID: "c2", SubOrganizationIds: []string{"c1"}},
+		},
+		fail: map[string]int{},
+	}
+	c := newTestClient(t, platform, 4)
+	warnings := captureWarnings(c)
+
+	root, err := c.InitTree(context.Background(), "root")
+	if err != nil {
+		t.Fatalf("InitTree: %v", err)
+	}
+	if got, want := orgIDs(root), []string{"root", "c1", "c2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("orgs = %v, want %v", got, want)
+	}
+	for _, id := range []string{"root", "c1", "c2"} {
+		if n := platform.requested(id); n != 1 {
+			t.Errorf("%s fetched %d times, want 1", id, n)
+		}
+	}
+	if want := []WarningCode{WarnDuplicateOrg}; !reflect.DeepEqual(*warnings, want) {
+		t.Errorf("warnings = %v, want one %s", *warnings, WarnDuplicateOrg)
+	}
+}
+
+func TestInitTreeSelfCycle(t *testing.T) {
+	platform := &fakePlatform{
+		orgs: map[string]Organization{
+			"root": {Name: "Root", ID: "root", SubOrganizationIds: []string{"c1"}},
+			"c1":   {Name: "C1", ID: "c1", SubOrganizationIds: []string{"c1"}},
+		},
+		fail: map[string]int{},
+	}
+	c := newTestClient(t, platform, 1)
+	warnings := captureWarnings(c)
+
+	root, err := c.InitTree(context.Background(), "root")
+	if err != nil {
+		t.Fatalf("InitTree: %v", err)
+	}
+	if got, want := orgIDs(root), []string{"root", "c1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("orgs = %v, want %v", got, want)
+	}
+	if want := []WarningCode{WarnDuplicateOrg}; !reflect.DeepEqual(*warnings, want) {
+		t.Errorf("warnings = %v, want one %s", *warnings, WarnDuplicateOrg)
+	}
+}
+
+// reload writes root out as a metrics.json and loads it back, as -retry-from does.
+func reload(t *testing.T, root *Node) *Node {
+	t.Helper()
+	b, err := json.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loaded
+}
+
+// buildSample fetches the whole of samplePlatform with what it fails to load marked.
+func buildSample(t *testing.T, platform *fakePlatform) *Node {
+	t.Helper()
+	c := newTestClient(t, platform, 4)
+	root, _ := c.InitTree(context.Background(), "root")
+	if root == nil {
+		t.Fatal("no tree")
+	}
+	c.GenerateApplications(context.Background(), root)
+	root.Normalize()
+	return reload(t, root)
+}
+
+func TestRetryFailuresFailedParentWithChildren(t *testing.T) {
+	platform := samplePlatform()
+	previous := buildSample(t, platform)
+
+	// Mark a as failed, as a later snapshot that couldn't fetch it would, while keeping the a1 that
+	// was fetched below it before.
+	a := previous.Children[0]
+	a.BusinessOrganization = Organization{ID: "a"}
+	a.Error = "organization a: HTTP status 503"
+	a.Children[0].BusinessOrganization.Environments = []*Environment{{ID: "a1-prod", Name: "Production", Applications: []*Application{{Domain: "kept"}}}}
+	previous = reload(t, previous)
+
+	// Since then a has gained a second sub-organization.
+	platform.orgs["a"] = Organization{Name: "A", ID: "a", SubOrganizationIds: []string{"a1", "a2"},
+		Environments: []*Environment{{ID: "a-prod", Name: "Production"}}}
+	platform.orgs["a2"] = Organization{Name: "A2", ID: "a2"}
+	platform.requests = nil
+
+	c := newTestClient(t, platform, 4)
+	if err := c.RetryFailures(context.Background(), previous); err != nil {
+		t.Fatalf("RetryFailures: %v", err)
+	}
+	previous.Normalize()
+
+	if got, want := orgIDs(previous), []string{"root", "a", "a1", "a2", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("orgs = %v, want %v", got, want)
+	}
+	a = findOrg(previous, "a")
+	if (a.Error != "") || (a.BusinessOrganization.Name != "A") {
+		t.Errorf("a = %q, error %q, want it fetched again", a.BusinessOrganization.Name, a.Error)
+	}
+	if got := len(a.BusinessOrganization.Environments[0].Applications); got != 2 {
+		t.Errorf("a-prod has %d applications, want 2", got)
+	}
+	if apps := a.Children[0].BusinessOrganization.Environments[0].Applications; (len(apps) != 1) || (apps[0].Domain != "kept") {
+		t.Errorf("a1's applications were replaced: %v", apps)
+	}
+	for _, id := range []string{"root", "a1", "b", "root-prod", "b-prod"} {
+		if n := platform.requested(id); n != 0 {
+			t.Errorf("%s fetched %d times, want 0 since it succeeded before", id, n)
+		}
+	}
+	if got := a.Children[0].Depth(); got != 2 {
+		t.Errorf("a1 depth = %d, want 2", got)
+	}
+}
+
+func TestRetryFailuresParentFailsAgain(t *testing.T) {
+	platform := samplePlatform()
+	previous := buildSample(t, platform)
+	a := previous.Children[0]
+	a.BusinessOrganization = Organization{ID: "a"}
+	a.Error = "organization a: HTTP status 503"
+	previous = reload(t, previous)
+
+	platform.fail["a"] = http.StatusForbidden
+	c := newTestClient(t, platform, 4)
+	err := c.RetryFailures(context.Background(), previous)
+	if (err == nil) || !strings.Contains(err.Error(), "organization a") {
+		t.Fatalf("RetryFailures error = %v, want one naming organization a", err)
+	}
+	previous.Normalize()
+
+	if got, want := orgIDs(previous), []string{"root", "a", "a1", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("orgs = %v, want %v, with a1 kept", got, want)
+	}
+	if a := findOrg(previous, "a"); !strings.Contains(a.Error, "403") {
+		t.Errorf("a error = %q, want the new failure", a.Error)
+	}
+}
+
+func TestRetryFailuresMissingAndFailed(t *testing.T) {
+	platform := samplePlatform()
+	platform.fail["b"] = http.StatusForbidden
+	platform.fail["a-dev"] = http.StatusForbidden
+	previous := buildSample(t, platform)
+
+	// A sub-organization that was listed but never fetched, as after a cancelled run.
+	a1 := findOrg(previous, "a1")
+	a1.BusinessOrganization.SubOrganizationIds = []string{"a1x"}
+	platform.orgs["a1"] = a1.BusinessOrganization
+	platform.orgs["a1x"] = Organization{Name: "A1X", ID: "a1x"}
+	previous = reload(t, previous)
+
+	delete(platform.fail, "b")
+	delete(platform.fail, "a-dev")
+	platform.requests = nil
+	c := newTestClient(t, platform, 4)
+	if err := c.RetryFailures(context.Background(), previous); err != nil {
+		t.Fatalf("RetryFailures: %v", err)
+	}
+	previous.Normalize()
+
+	if got, want := orgIDs(previous), []string{"root", "a", "a1", "a1x", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("orgs = %v, want %v", got, want)
+	}
+	if b := findOrg(previous, "b"); (b.Error != "") || (b.BusinessOrganization.Environments[0].Applications == nil) {
+		t.Errorf("b = %+v, want it and its environments fetched", b)
+	}
+	sandbox := findOrg(previous, "a").BusinessOrganization.Environments[1]
+	if (sandbox.Error != "") || (len(sandbox.Applications) != 1) {
+		t.Errorf("a-dev = %+v, want its applications fetched", sandbox)
+	}
+	for _, id := range []string{"root", "a", "a1", "a-prod"} {
+		if n := platform.requested(id); n != 0 {
+			t.Errorf("%s fetched %d times, want 0", id, n)
+		}
+	}
+}